@@ -7,6 +7,40 @@ CREATE DATABASE "bitburst" WITH owner=postgres;
 EOSQL
 psql -U postgres --dbname bitburst -tc "
 CREATE TABLE IF NOT EXISTS objects (
-    id              INT          PRIMARY KEY,
-    last_seen_at    TIMESTAMP
-);"
+    id              TEXT         PRIMARY KEY,
+    last_seen_at    TIMESTAMPTZ(6),
+    seen_count      BIGINT       NOT NULL DEFAULT 0,
+    online          BOOLEAN      NOT NULL DEFAULT TRUE,
+    label           TEXT,
+    claimed_until   TIMESTAMPTZ(6),
+    created_at      TIMESTAMPTZ(6) DEFAULT now()
+);
+ALTER TABLE objects ADD COLUMN IF NOT EXISTS seen_count BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE objects ADD COLUMN IF NOT EXISTS online BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE objects ADD COLUMN IF NOT EXISTS label TEXT;
+ALTER TABLE objects ADD COLUMN IF NOT EXISTS claimed_until TIMESTAMPTZ(6);
+ALTER TABLE objects ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ(6) DEFAULT now();
+CREATE INDEX IF NOT EXISTS objects_last_seen_at_idx ON objects (last_seen_at);
+CREATE TABLE IF NOT EXISTS object_events (
+    id              BIGSERIAL    PRIMARY KEY,
+    object_id       TEXT         NOT NULL,
+    kind            TEXT         NOT NULL,
+    at              TIMESTAMPTZ(6)
+);
+DO \$\$
+BEGIN
+    IF (SELECT data_type FROM information_schema.columns WHERE table_name = 'objects' AND column_name = 'last_seen_at') = 'timestamp without time zone' THEN
+        ALTER TABLE objects ALTER COLUMN last_seen_at TYPE TIMESTAMPTZ(6) USING last_seen_at AT TIME ZONE 'UTC';
+    END IF;
+    IF (SELECT data_type FROM information_schema.columns WHERE table_name = 'object_events' AND column_name = 'at') = 'timestamp without time zone' THEN
+        ALTER TABLE object_events ALTER COLUMN at TYPE TIMESTAMPTZ(6) USING at AT TIME ZONE 'UTC';
+    END IF;
+    IF (SELECT data_type FROM information_schema.columns WHERE table_name = 'objects' AND column_name = 'id') = 'integer' THEN
+        ALTER TABLE objects ALTER COLUMN id TYPE TEXT USING id::text;
+    END IF;
+    IF (SELECT data_type FROM information_schema.columns WHERE table_name = 'object_events' AND column_name = 'object_id') = 'integer' THEN
+        ALTER TABLE object_events ALTER COLUMN object_id TYPE TEXT USING object_id::text;
+    END IF;
+END
+\$\$;
+CREATE INDEX IF NOT EXISTS objects_id_order_idx ON objects (length(id), id);"
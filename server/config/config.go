@@ -1,8 +1,10 @@
 package config
 
 import (
+	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/pkg/errors"
@@ -40,6 +42,7 @@ func Load() (*config, error) {
 		if err != nil {
 			return
 		}
+		err = validatePorts(cfg)
 	})
 	return cfg, err
 }
@@ -57,6 +60,10 @@ func loadServiceCfg() (service.Config, error) {
 	if err != nil {
 		return service.Config{}, err
 	}
+	serviceCfg.ChannelBufferSize, err = lookupInt("CHANNEL_BUFFER_SIZE", 0)
+	if err != nil {
+		return service.Config{}, err
+	}
 	retentionStr, ok := os.LookupEnv("RETENTION_POLICY_SEC")
 	if !ok {
 		return service.Config{}, errNoConfigFound
@@ -65,6 +72,9 @@ func loadServiceCfg() (service.Config, error) {
 	if err != nil {
 		return service.Config{}, err
 	}
+	if serviceCfg.RetentionPolicySec <= 0 { // timers would fire right away, deleting every object just stored
+		return service.Config{}, errors.Errorf("RETENTION_POLICY_SEC must be positive, got %v", serviceCfg.RetentionPolicySec)
+	}
 	serviceCfg.HTTP.ListenPort, ok = os.LookupEnv("LISTEN_PORT")
 	if !ok {
 		return service.Config{}, errNoConfigFound
@@ -77,6 +87,63 @@ func loadServiceCfg() (service.Config, error) {
 	if !ok {
 		return service.Config{}, errNoConfigFound
 	}
+	serviceCfg.HTTP.TesterScheme = lookupString("TESTER_SCHEME", "http")
+	serviceCfg.HTTP.TesterMethod = strings.ToUpper(lookupString("TESTER_METHOD", http.MethodGet))
+	if serviceCfg.HTTP.TesterMethod != http.MethodGet && serviceCfg.HTTP.TesterMethod != http.MethodPost {
+		return service.Config{}, errors.Errorf("TESTER_METHOD must be GET or POST, got %q", serviceCfg.HTTP.TesterMethod)
+	}
+	serviceCfg.HTTP.TesterCertFile = lookupString("TESTER_CERT_FILE", "")
+	serviceCfg.HTTP.TesterKeyFile = lookupString("TESTER_KEY_FILE", "")
+	serviceCfg.HTTP.TesterCAFile = lookupString("TESTER_CA_FILE", "")
+	serviceCfg.HTTP.TesterInsecureSkipVerify, err = lookupBool("TESTER_INSECURE_SKIP_VERIFY", false)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.HTTP.StrictTesterResponse, err = lookupBool("STRICT_TESTER_RESPONSE", false)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.HTTP.TesterDisableRedirects, err = lookupBool("TESTER_DISABLE_REDIRECTS", false)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.HTTP.TesterRPS, err = lookupInt("TESTER_RPS", 0)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.HTTP.TesterBurst, err = lookupInt("TESTER_BURST", 1)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.HTTP.FetchMaxRetries, err = lookupInt("FETCH_MAX_RETRIES", 0)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.HTTP.FetchBackoffBaseMs, err = lookupInt("FETCH_BACKOFF_BASE_MS", 100)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.HTTP.CompressObjects, err = lookupBool("COMPRESS_OBJECTS", false)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.HTTP.ObjectsTimeoutMs, err = lookupInt("OBJECTS_TIMEOUT_MS", 0)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.HTTP.AdminTimeoutMs, err = lookupInt("ADMIN_TIMEOUT_MS", 0)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.HTTP.TesterSelfTest, err = lookupBool("TESTER_SELF_TEST", false)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.HTTP.TesterSelfTestPath = lookupString("TESTER_SELF_TEST_PATH", "/objects/1")
+	serviceCfg.HTTP.TesterSelfTestRetries, err = lookupInt("TESTER_SELF_TEST_RETRIES", 3)
+	if err != nil {
+		return service.Config{}, err
+	}
 	timeoutStr, ok := os.LookupEnv("TIMEOUT_SEC")
 	if !ok {
 		return service.Config{}, errNoConfigFound
@@ -85,6 +152,189 @@ func loadServiceCfg() (service.Config, error) {
 	if err != nil {
 		return service.Config{}, err
 	}
+	serviceCfg.MinRetentionSec, err = lookupInt("MIN_RETENTION_SEC", 0)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.MaxRetentionSec, err = lookupInt("MAX_RETENTION_SEC", 0)
+	if err != nil {
+		return service.Config{}, err
+	}
+	if serviceCfg.MinRetentionSec > 0 && serviceCfg.MaxRetentionSec > 0 && serviceCfg.MinRetentionSec > serviceCfg.MaxRetentionSec {
+		return service.Config{}, errors.Errorf("MIN_RETENTION_SEC=%v is above MAX_RETENTION_SEC=%v", serviceCfg.MinRetentionSec, serviceCfg.MaxRetentionSec)
+	}
+	serviceCfg.CallbackDebugEcho, err = lookupBool("CALLBACK_DEBUG_ECHO", false)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.ConfirmOffline, err = lookupBool("CONFIRM_OFFLINE", false)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.ConfirmOfflineDelayMs, err = lookupInt("CONFIRM_OFFLINE_DELAY_MS", 500)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.MaxConcurrentFetches, err = lookupInt("MAX_CONCURRENT_FETCHES", 0)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.CallbackCoalesceMs, err = lookupInt("CALLBACK_COALESCE_MS", 0)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.DeleteNotifyChannel = lookupString("DELETE_NOTIFY_CHANNEL", "")
+	serviceCfg.BackfillSource = lookupString("BACKFILL_SOURCE", "")
+	serviceCfg.SkipColdStart, err = lookupBool("SKIP_COLD_START", false)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.ColdStartWorkers, err = lookupInt("COLD_START_WORKERS", 4)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.ColdStartBatchSize, err = lookupInt("COLD_START_BATCH_SIZE", 500)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.ColdStartPageSize, err = lookupInt("COLD_START_PAGE_SIZE", 0)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.ColdStartMaxQueries, err = lookupInt("COLD_START_MAX_QUERIES", 2)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.ColdStartRetries, err = lookupInt("COLD_START_RETRIES", 3)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.ColdStartBackoffMs, err = lookupInt("COLD_START_BACKOFF_MS", 500)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.CaptureMalformedCallbacks, err = lookupBool("CAPTURE_MALFORMED_CALLBACKS", false)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.StrictCallbackFields, err = lookupBool("STRICT_CALLBACK_FIELDS", false)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.EventsURL = lookupString("EVENTS_URL", "")
+	serviceCfg.ReceiptsURL = lookupString("RECEIPTS_URL", "")
+	serviceCfg.ProcessingTimeoutSec, err = lookupInt("PROCESSING_TIMEOUT_SEC", 0)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.UpsertBatchSize, err = lookupInt("UPSERT_BATCH_SIZE", 1)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.UpsertFlushMs, err = lookupInt("UPSERT_FLUSH_MS", 1000)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.DeleteBatchSize, err = lookupInt("DELETE_BATCH_SIZE", 1)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.DeleteFlushMs, err = lookupInt("DELETE_FLUSH_MS", 1000)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.DeleteCooldownMs, err = lookupInt("DELETE_COOLDOWN_MS", 0)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.RejectCallbacksDuringColdStart, err = lookupBool("REJECT_CALLBACKS_DURING_COLD_START", false)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.CallbackEnqueueTimeoutSec, err = lookupInt("CALLBACK_ENQUEUE_TIMEOUT_SEC", 30)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.MaxConcurrentCallbacks, err = lookupInt("MAX_CONCURRENT_CALLBACKS", 0)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.DrainDelaySec, err = lookupInt("DRAIN_DELAY_SEC", 0)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.MaxCallbackBodyBytes, err = lookupInt("MAX_CALLBACK_BODY_BYTES", 1<<20)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.DBTimeoutMs, err = lookupInt("DB_TIMEOUT_MS", 0)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.DBDeadlineRetries, err = lookupInt("DB_DEADLINE_RETRIES", 0)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.WorkerShards, err = lookupInt("WORKER_SHARDS", 0)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.DBMaxConcurrentWrites, err = lookupInt("DB_MAX_CONCURRENT_WRITES", 0)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.DebugEndpoints, err = lookupBool("DEBUG_ENDPOINTS", false)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.ExposeConfig, err = lookupBool("EXPOSE_CONFIG", false)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.UpsertOffline, err = lookupBool("UPSERT_OFFLINE", false)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.StringIDs, err = lookupBool("STRING_IDS", false)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.RecordObservations, err = lookupBool("RECORD_OBSERVATIONS", false)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.StoreLabels, err = lookupBool("STORE_LABELS", false)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.TrackTransitions, err = lookupBool("TRACK_TRANSITIONS", false)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.DeleteMetricsBySource, err = lookupBool("DELETE_METRICS_BY_SOURCE", false)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.MetricsLogIntervalSec, err = lookupInt("METRICS_LOG_INTERVAL_SEC", 0)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.ShutdownTimeoutSec, err = lookupInt("SHUTDOWN_TIMEOUT_SEC", 10)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.LogObjectID, err = lookupBool("LOG_OBJECT_ID", false)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.RetryBudget, err = lookupInt("RETRY_BUDGET", 0)
+	if err != nil {
+		return service.Config{}, err
+	}
+	serviceCfg.RetryBudgetRefillPerSec, err = lookupInt("RETRY_BUDGET_REFILL_PER_SEC", 1)
+	if err != nil {
+		return service.Config{}, err
+	}
 	return serviceCfg, nil
 }
 
@@ -101,9 +351,37 @@ func loadLoggerCfg() (logger.Config, error) {
 			return logCfg, err
 		}
 	}
+	logCfg.Level = strings.ToLower(lookupString("LOG_LEVEL", ""))
+	switch logCfg.Level {
+	case "", "debug", "info", "warn", "error":
+	default:
+		return logCfg, errors.Errorf("LOG_LEVEL must be debug, info, warn or error, got %q", logCfg.Level)
+	}
 	return logCfg, nil
 }
 
+// validatePorts rejects a LISTEN_PORT shared with the tester or postgres on the same machine,
+// a common slip in local setups that otherwise shows up as the service calling itself.
+// Metrics and admin routes are served on LISTEN_PORT too, so they can't collide.
+func validatePorts(cfg *config) error {
+	listen := cfg.Service.HTTP.ListenPort
+	if isLocalHost(cfg.Service.HTTP.TesterHost) && cfg.Service.HTTP.TesterPort == listen {
+		return errors.Errorf("TESTER_PORT and LISTEN_PORT are both %s on local host %q", listen, cfg.Service.HTTP.TesterHost)
+	}
+	if isLocalHost(cfg.Postgres.Host) && cfg.Postgres.Port == listen {
+		return errors.Errorf("POSTGRES_PORT and LISTEN_PORT are both %s on local host %q", listen, cfg.Postgres.Host)
+	}
+	return nil
+}
+
+func isLocalHost(host string) bool {
+	switch strings.ToLower(host) {
+	case "", "localhost", "127.0.0.1", "::1", "0.0.0.0":
+		return true
+	}
+	return false
+}
+
 func loadPostgresCfg() (postgres.Config, error) {
 	var (
 		pgCfg = postgres.Config{}
@@ -136,5 +414,40 @@ func loadPostgresCfg() (postgres.Config, error) {
 	if pgCfg.Password, ok = os.LookupEnv("POSTGRES_PASSWORD"); !ok {
 		return pgCfg, errNoConfigFound
 	}
+	if pgCfg.HealthCheckPeriodSec, err = lookupInt("POSTGRES_HEALTH_CHECK_PERIOD_SEC", 0); err != nil {
+		return pgCfg, err
+	}
+	if pgCfg.PingBeforeAcquire, err = lookupBool("POSTGRES_PING_BEFORE_ACQUIRE", false); err != nil {
+		return pgCfg, err
+	}
+	if pgCfg.AcquireTimeoutMs, err = lookupInt("POSTGRES_ACQUIRE_TIMEOUT_MS", 0); err != nil {
+		return pgCfg, err
+	}
 	return pgCfg, nil
 }
+
+// lookupString reads an optional env variable, falling back to def when it is not set
+func lookupString(key string, def string) string {
+	if raw, ok := os.LookupEnv(key); ok {
+		return raw
+	}
+	return def
+}
+
+// lookupBool reads an optional boolean env variable, falling back to def when it is not set
+func lookupBool(key string, def bool) (bool, error) {
+	raw, ok := os.LookupEnv(key)
+	if !ok {
+		return def, nil
+	}
+	return strconv.ParseBool(raw)
+}
+
+// lookupInt reads an optional integer env variable, falling back to def when it is not set
+func lookupInt(key string, def int) (int, error) {
+	raw, ok := os.LookupEnv(key)
+	if !ok {
+		return def, nil
+	}
+	return strconv.Atoi(raw)
+}
@@ -0,0 +1,107 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// setEnv sets the required service variables plus extra for the duration of the test
+func setEnv(t *testing.T, extra map[string]string) {
+	t.Helper()
+	vars := map[string]string{
+		"MAX_OBJECTS_PER_REQUEST": "200",
+		"RETENTION_POLICY_SEC":    "30",
+		"LISTEN_PORT":             "9090",
+		"TESTER_HOST":             "tester",
+		"TESTER_PORT":             "9010",
+		"TIMEOUT_SEC":             "5",
+	}
+	for k, v := range extra {
+		vars[k] = v
+	}
+	for k, v := range vars {
+		prev, had := os.LookupEnv(k)
+		if err := os.Setenv(k, v); err != nil {
+			t.Fatal(err)
+		}
+		k := k
+		t.Cleanup(func() {
+			if had {
+				os.Setenv(k, prev)
+			} else {
+				os.Unsetenv(k)
+			}
+		})
+	}
+}
+
+func TestRetentionBoundsMustBeOrdered(t *testing.T) {
+	setEnv(t, map[string]string{"MIN_RETENTION_SEC": "60", "MAX_RETENTION_SEC": "10"})
+	if _, err := loadServiceCfg(); err == nil || !strings.Contains(err.Error(), "MIN_RETENTION_SEC=60 is above MAX_RETENTION_SEC=10") {
+		t.Fatalf("inverted retention bounds loaded, got %v", err)
+	}
+}
+
+func TestRetentionBoundsLoad(t *testing.T) {
+	setEnv(t, map[string]string{"MIN_RETENTION_SEC": "10", "MAX_RETENTION_SEC": "60"})
+	cfg, err := loadServiceCfg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MinRetentionSec != 10 || cfg.MaxRetentionSec != 60 {
+		t.Fatalf("loaded retention bounds %v..%v, want 10..60", cfg.MinRetentionSec, cfg.MaxRetentionSec)
+	}
+}
+
+func TestCollidingPortsRejected(t *testing.T) {
+	for _, tc := range []struct {
+		name                   string
+		testerHost, testerPort string
+		pgHost, pgPort         string
+		wantErr                string
+	}{
+		{"tester on listen port", "localhost", "9090", "postgres", "9090", "TESTER_PORT and LISTEN_PORT are both 9090"},
+		{"tester on loopback", "127.0.0.1", "9090", "postgres", "5432", "TESTER_PORT and LISTEN_PORT are both 9090"},
+		{"postgres on listen port", "tester", "9010", "LOCALHOST", "9090", "POSTGRES_PORT and LISTEN_PORT are both 9090"},
+		{"same ports on other hosts", "tester", "9090", "postgres", "9090", ""},
+		{"distinct local ports", "localhost", "9010", "localhost", "5432", ""},
+	} {
+		cfg := &config{}
+		cfg.Service.HTTP.ListenPort = "9090"
+		cfg.Service.HTTP.TesterHost, cfg.Service.HTTP.TesterPort = tc.testerHost, tc.testerPort
+		cfg.Postgres.Host, cfg.Postgres.Port = tc.pgHost, tc.pgPort
+		err := validatePorts(cfg)
+		switch {
+		case tc.wantErr == "" && err != nil:
+			t.Errorf("%s: rejected with %v", tc.name, err)
+		case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+			t.Errorf("%s: got %v, want an error containing %q", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestNonPositiveRetentionRejected(t *testing.T) {
+	for _, retention := range []string{"0", "-5"} {
+		setEnv(t, map[string]string{"RETENTION_POLICY_SEC": retention})
+		_, err := loadServiceCfg()
+		if err == nil || !strings.Contains(err.Error(), "RETENTION_POLICY_SEC must be positive, got "+retention) {
+			t.Errorf("RETENTION_POLICY_SEC=%s loaded, got %v", retention, err)
+		}
+	}
+	setEnv(t, map[string]string{"RETENTION_POLICY_SEC": "1"})
+	if _, err := loadServiceCfg(); err != nil {
+		t.Errorf("RETENTION_POLICY_SEC=1 rejected: %v", err)
+	}
+}
+
+func TestObjectIDLogFieldOptIn(t *testing.T) {
+	setEnv(t, nil)
+	if cfg, err := loadServiceCfg(); err != nil || cfg.LogObjectID {
+		t.Fatalf("LogObjectID defaults to %v (err %v), want the log format unchanged unless LOG_OBJECT_ID is set", cfg.LogObjectID, err)
+	}
+	setEnv(t, map[string]string{"LOG_OBJECT_ID": "true"})
+	if cfg, err := loadServiceCfg(); err != nil || !cfg.LogObjectID {
+		t.Fatalf("LOG_OBJECT_ID=true loaded LogObjectID=%v, err %v", cfg.LogObjectID, err)
+	}
+}
@@ -0,0 +1,52 @@
+package events
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/poodbooq/bitburst_server/models"
+	"github.com/poodbooq/bitburst_server/webhook"
+)
+
+type Kind string
+
+const (
+	KindSeen    Kind = "seen"    // object observed online while it wasn't known to be online
+	KindOffline Kind = "offline" // object known to be online observed offline
+)
+
+type Event struct {
+	ObjectID models.ID `json:"object_id"`
+	Kind     Kind      `json:"kind"`
+	At       time.Time `json:"at"`
+}
+
+type Publisher interface {
+	Publish(ctx context.Context, event Event) error
+}
+
+type noop struct{}
+
+func NewNoop() Publisher {
+	return noop{}
+}
+
+func (noop) Publish(context.Context, Event) error {
+	return nil
+}
+
+type httpPublisher struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTP publishes every event as a JSON POST to url
+func NewHTTP(url string, client *http.Client) Publisher {
+	return &httpPublisher{url: url, client: client}
+}
+
+func (p *httpPublisher) Publish(ctx context.Context, event Event) error {
+	return errors.Wrapf(webhook.PostJSON(ctx, p.client, p.url, event), "publishing %s event for id %v", event.Kind, event.ObjectID)
+}
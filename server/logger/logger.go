@@ -1,47 +1,80 @@
 package logger
 
 import (
+	"net/http"
 	"sync"
 
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 type Logger interface {
 	Warn(msg string, args ...interface{})
 	Info(msg string, args ...interface{})
-	Error(err error, args ...interface{})
+	Error(err error, keysAndValues ...interface{}) // logs err as is, never as a format string
 	Debug(msg string, args ...interface{})
+	With(key string, value interface{}) Logger // returns a logger adding the structured field to every line
+}
+
+// ClosableLogger is a Logger that has to be flushed before exiting
+type ClosableLogger interface {
+	Logger
+	Close() error
+}
+
+// LevelHandler is implemented by loggers whose level can be changed at runtime,
+// the handler reports the level on GET and changes it on PUT of {"level":"<level>"}
+type LevelHandler interface {
+	LevelHandler() http.Handler
 }
 
 type Config struct {
 	IsProduction bool
+	Level        string // debug, info, warn or error, empty keeps the default of IsProduction
 }
 
 type logger struct {
-	log *zap.Logger
+	log   *zap.Logger
+	level zap.AtomicLevel
 }
 
 var (
 	singleton *logger
-	once      = new(sync.Once)
+	mu        = new(sync.Mutex)
+
+	buildZap = func(cfg zap.Config) (*zap.Logger, error) { return cfg.Build() } // replaced by tests to make construction fail
 )
 
-func Get(cfg Config) (*logger, error) {
-	var err error
-	once.Do(func() {
-		singleton = new(logger)
-		getZapFunc := zap.NewDevelopment
-		if cfg.IsProduction {
-			getZapFunc = zap.NewProduction
+// Get builds the logger on the first successful call and returns the same instance afterwards.
+// A failed construction is not cached, so the next call retries it and reports its own error.
+// Even then a usable standard library backed logger is returned, so errors can still be reported.
+func Get(cfg Config) (ClosableLogger, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if singleton != nil {
+		return singleton, nil
+	}
+	zapCfg := zap.NewDevelopmentConfig()
+	if cfg.IsProduction {
+		zapCfg = zap.NewProductionConfig()
+	}
+	if cfg.Level != "" {
+		var level zapcore.Level
+		if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+			return newStdLogger(), err
 		}
-		singleton.log, err = getZapFunc()
-		if err != nil {
-			return
-		}
-
-	})
+		zapCfg.Level.SetLevel(level)
+	}
+	zapLog, err := buildZap(zapCfg)
+	if err != nil {
+		return newStdLogger(), err
+	}
+	singleton = &logger{log: zapLog, level: zapCfg.Level}
+	return singleton, nil
+}
 
-	return singleton, err
+func (l *logger) LevelHandler() http.Handler {
+	return l.level
 }
 
 func (l *logger) Close() error {
@@ -54,9 +87,12 @@ func (l *logger) Info(msg string, args ...interface{}) {
 func (l *logger) Warn(msg string, args ...interface{}) {
 	l.log.Sugar().Warnf(msg, args...)
 }
-func (l *logger) Error(err error, args ...interface{}) {
-	l.log.Sugar().Errorf(err.Error(), args...)
+func (l *logger) Error(err error, keysAndValues ...interface{}) {
+	l.log.Sugar().Errorw(err.Error(), keysAndValues...)
 }
 func (l *logger) Debug(msg string, args ...interface{}) {
 	l.log.Sugar().Debugf(msg, args...)
 }
+func (l *logger) With(key string, value interface{}) Logger {
+	return &logger{log: l.log.With(zap.Any(key, value)), level: l.level}
+}
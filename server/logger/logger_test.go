@@ -0,0 +1,88 @@
+package logger
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// resetSingleton forgets the logger built by Get, before and after the test
+func resetSingleton(t *testing.T) {
+	reset := func() {
+		mu.Lock()
+		singleton = nil
+		mu.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestFailedGetIsRetried(t *testing.T) {
+	resetSingleton(t)
+	bad := Config{Level: "loud"}
+	for i := 0; i < 2; i++ {
+		if _, err := Get(bad); err == nil {
+			t.Fatalf("Get #%v with level %q succeeded", i+1, bad.Level)
+		}
+	}
+
+	first, err := Get(Config{Level: "warn"})
+	if err != nil {
+		t.Fatalf("Get after fixing the level failed: %v", err)
+	}
+	second, err := Get(bad)
+	if err != nil || second != first {
+		t.Fatalf("Get after a successful one returned %p, %v, want the cached %p", second, err, first)
+	}
+}
+
+func TestFallbackWhenZapFails(t *testing.T) {
+	resetSingleton(t)
+	build := buildZap
+	buildZap = func(zap.Config) (*zap.Logger, error) { return nil, errors.New("open /dev/stderr: too many open files") }
+	defer func() { buildZap = build }()
+
+	log, err := Get(Config{IsProduction: true})
+	if err == nil {
+		t.Fatal("Get hid the zap failure")
+	}
+	fallback, ok := log.(*stdLogger)
+	if !ok {
+		t.Fatalf("Get returned %T after zap failed, want the standard library fallback", log)
+	}
+	var out bytes.Buffer
+	fallback.log.SetOutput(&out)
+	log.With("object_id", 7).Error(errors.New("delete failed"), "attempt", 2)
+	log.Warn("retrying in %v", "1s")
+	if lines := out.String(); !strings.Contains(lines, "ERROR\tdelete failed\tobject_id=7\tattempt=2") || !strings.Contains(lines, "WARN\tretrying in 1s") {
+		t.Fatalf("fallback logged:\n%s", lines)
+	}
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestErrorWithPercentLoggedVerbatim(t *testing.T) {
+	const msg = `pq: invalid input syntax for type bigint: "%s" at /objects?id=%d`
+	core, logs := observer.New(zap.DebugLevel)
+	(&logger{log: zap.New(core)}).Error(errors.New(msg), "attempt", 2)
+	entries := logs.All()
+	if len(entries) != 1 || entries[0].Message != msg {
+		t.Fatalf("zap logged %+v, want the message %q", entries, msg)
+	}
+	if attempt := entries[0].ContextMap()["attempt"]; attempt != int64(2) {
+		t.Errorf("attempt field = %v, want 2", attempt)
+	}
+
+	fallback := newStdLogger()
+	var out bytes.Buffer
+	fallback.log.SetOutput(&out)
+	fallback.Error(errors.New(msg))
+	if line := out.String(); !strings.Contains(line, "ERROR\t"+msg) || strings.Contains(line, "%!") {
+		t.Fatalf("fallback logged %q", line)
+	}
+}
@@ -0,0 +1,41 @@
+package logger
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+// stdLogger is the fallback used when zap can't be built
+type stdLogger struct {
+	log    *log.Logger
+	fields string // added by With, appended to every line
+}
+
+func newStdLogger() *stdLogger {
+	return &stdLogger{log: log.New(os.Stderr, "", log.LstdFlags|log.LUTC)}
+}
+
+func (l *stdLogger) Close() error {
+	return nil
+}
+
+func (l *stdLogger) Info(msg string, args ...interface{}) {
+	l.log.Print("INFO\t", fmt.Sprintf(msg, args...), l.fields)
+}
+func (l *stdLogger) Warn(msg string, args ...interface{}) {
+	l.log.Print("WARN\t", fmt.Sprintf(msg, args...), l.fields)
+}
+func (l *stdLogger) Error(err error, keysAndValues ...interface{}) {
+	fields := l.fields
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		fields += fmt.Sprintf("\t%v=%v", keysAndValues[i], keysAndValues[i+1])
+	}
+	l.log.Print("ERROR\t", err.Error(), fields)
+}
+func (l *stdLogger) Debug(msg string, args ...interface{}) {
+	l.log.Print("DEBUG\t", fmt.Sprintf(msg, args...), l.fields)
+}
+func (l *stdLogger) With(key string, value interface{}) Logger {
+	return &stdLogger{log: l.log, fields: fmt.Sprintf("%s\t%s=%v", l.fields, key, value)}
+}
@@ -0,0 +1,114 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/poodbooq/bitburst_server/logger"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type Metrics struct {
+	registry *prometheus.Registry
+	log      logger.Logger
+}
+
+func New(log logger.Logger) *Metrics {
+	return &Metrics{
+		registry: prometheus.NewRegistry(), // own registry per instance, so nothing leaks into the global default one
+		log:      log,
+	}
+}
+
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{
+		ErrorLog:      errorLog{m.log},
+		ErrorHandling: promhttp.ContinueOnError, // serve whatever could be gathered instead of failing the whole scrape
+	})
+}
+
+// Summary renders the current value of every metric on one line, for environments without a scraper.
+// Histograms are reduced to their sample count and sum.
+func (m *Metrics) Summary() (string, error) {
+	families, err := m.registry.Gather()
+	if err != nil {
+		return "", err
+	}
+	var fields []string
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			name := family.GetName() + formatLabels(metric.GetLabel())
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				fields = append(fields, fmt.Sprintf("%s=%v", name, metric.GetCounter().GetValue()))
+			case dto.MetricType_GAUGE:
+				fields = append(fields, fmt.Sprintf("%s=%v", name, metric.GetGauge().GetValue()))
+			case dto.MetricType_HISTOGRAM:
+				h := metric.GetHistogram()
+				fields = append(fields, fmt.Sprintf("%s_count=%v", name, h.GetSampleCount()), fmt.Sprintf("%s_sum=%v", name, h.GetSampleSum()))
+			}
+		}
+	}
+	sort.Strings(fields)
+	return strings.Join(fields, " "), nil
+}
+
+func formatLabels(labels []*dto.LabelPair) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(labels))
+	for i, l := range labels {
+		pairs[i] = fmt.Sprintf("%s=%q", l.GetName(), l.GetValue())
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (m *Metrics) NewCounter(opts prometheus.CounterOpts) prometheus.Counter {
+	return m.register(prometheus.NewCounter(opts)).(prometheus.Counter)
+}
+
+func (m *Metrics) NewCounterVec(opts prometheus.CounterOpts, labels []string) *prometheus.CounterVec {
+	return m.register(prometheus.NewCounterVec(opts, labels)).(*prometheus.CounterVec)
+}
+
+func (m *Metrics) NewGauge(opts prometheus.GaugeOpts) prometheus.Gauge {
+	return m.register(prometheus.NewGauge(opts)).(prometheus.Gauge)
+}
+
+func (m *Metrics) NewGaugeFunc(opts prometheus.GaugeOpts, fn func() float64) prometheus.GaugeFunc {
+	return m.register(prometheus.NewGaugeFunc(opts, fn)).(prometheus.GaugeFunc)
+}
+
+func (m *Metrics) NewHistogram(opts prometheus.HistogramOpts) prometheus.Histogram {
+	return m.register(prometheus.NewHistogram(opts)).(prometheus.Histogram)
+}
+
+// register never panics: an already registered collector of the same kind is reused and any other
+// registration error, including a name taken by a different kind of metric, only leaves the collector unexported.
+func (m *Metrics) register(c prometheus.Collector) prometheus.Collector {
+	err := m.registry.Register(c)
+	if err == nil {
+		return c
+	}
+	alreadyRegistered, ok := err.(prometheus.AlreadyRegisteredError)
+	if ok && reflect.TypeOf(alreadyRegistered.ExistingCollector) == reflect.TypeOf(c) {
+		return alreadyRegistered.ExistingCollector
+	}
+	m.log.Error(errors.Wrap(err, "registering metric"))
+	return c
+}
+
+type errorLog struct {
+	log logger.Logger
+}
+
+func (l errorLog) Println(v ...interface{}) {
+	l.log.Error(errors.New(fmt.Sprint(v...)))
+}
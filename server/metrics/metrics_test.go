@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/poodbooq/bitburst_server/logger"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// errorsLogger collects the errors logged through it
+type errorsLogger struct {
+	errs *[]error
+}
+
+func (errorsLogger) Warn(string, ...interface{})  {}
+func (errorsLogger) Info(string, ...interface{})  {}
+func (errorsLogger) Debug(string, ...interface{}) {}
+func (l errorsLogger) Error(err error, _ ...interface{}) {
+	*l.errs = append(*l.errs, err)
+}
+func (l errorsLogger) With(string, interface{}) logger.Logger { return l }
+
+func TestRegisteringTwiceReusesTheCollector(t *testing.T) {
+	var errs []error
+	m := New(errorsLogger{&errs})
+	opts := prometheus.CounterOpts{Name: "callbacks_total", Help: "callbacks"}
+	first := m.NewCounter(opts)
+	second := m.NewCounter(opts)
+	second.Inc()
+	if first != second {
+		t.Fatal("re-registering a counter returned a second collector")
+	}
+	if len(errs) != 0 {
+		t.Fatalf("re-registering a counter logged %v", errs)
+	}
+}
+
+func TestConflictingRegistrationIsLoggedNotPanicked(t *testing.T) {
+	var errs []error
+	m := New(errorsLogger{&errs})
+	m.NewCounter(prometheus.CounterOpts{Name: "objects", Help: "objects"})
+	gauge := m.NewGauge(prometheus.GaugeOpts{Name: "objects", Help: "objects"})
+	gauge.Set(1) // still usable, only unexported
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "registering metric") {
+		t.Fatalf("conflicting registration logged %v", errs)
+	}
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "objects 0") {
+		t.Fatalf("/metrics answered %v after a conflicting registration: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestInstancesDontShareRegistrations(t *testing.T) {
+	var errs []error
+	for i := 0; i < 2; i++ {
+		m := New(errorsLogger{&errs})
+		m.NewCounter(prometheus.CounterOpts{Name: "callbacks_total", Help: "callbacks"}).Add(float64(i + 1))
+		summary, err := m.Summary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("callbacks_total=%v", i+1); summary != want {
+			t.Errorf("instance %v summarized %q, want %q", i, summary, want)
+		}
+	}
+	if len(errs) != 0 {
+		t.Fatalf("separate instances logged %v", errs)
+	}
+}
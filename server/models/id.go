@@ -0,0 +1,46 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// ID identifies an object. Testers may use integers or arbitrary strings like UUIDs, so ids are
+// kept as strings. Integer ids are read from and written as JSON numbers, so their wire format
+// stays the same.
+type ID string
+
+// IsInt reports whether id is an integer in its canonical decimal form
+func (id ID) IsInt() bool {
+	n, err := strconv.ParseInt(string(id), 10, 64)
+	return err == nil && strconv.FormatInt(n, 10) == string(id)
+}
+
+func (id ID) MarshalJSON() ([]byte, error) {
+	if id.IsInt() {
+		return []byte(id), nil
+	}
+	return json.Marshal(string(id))
+}
+
+// UnmarshalJSON accepts a JSON string or an integer number
+func (id *ID) UnmarshalJSON(b []byte) error {
+	b = bytes.TrimSpace(b)
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		*id = ID(s)
+		return nil
+	}
+	n, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return errors.Errorf("object id %s is neither a string nor an integer", b)
+	}
+	*id = ID(strconv.FormatInt(n, 10))
+	return nil
+}
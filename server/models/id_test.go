@@ -0,0 +1,41 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestIDJSON(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		id      ID
+		out     string
+		invalid bool
+	}{
+		{in: `42`, id: "42", out: `42`},
+		{in: `"42"`, id: "42", out: `42`},
+		{in: `-7`, id: "-7", out: `-7`},
+		{in: `"3f2b8c1e-9a4d-4e6f-8b7a-1c2d3e4f5a6b"`, id: "3f2b8c1e-9a4d-4e6f-8b7a-1c2d3e4f5a6b", out: `"3f2b8c1e-9a4d-4e6f-8b7a-1c2d3e4f5a6b"`},
+		{in: `"007"`, id: "007", out: `"007"`},
+		{in: `1.5`, invalid: true},
+		{in: `null`, invalid: true},
+		{in: `true`, invalid: true},
+	} {
+		var id ID
+		err := json.Unmarshal([]byte(tc.in), &id)
+		if tc.invalid {
+			if err == nil {
+				t.Errorf("decoding %s succeeded with %q, want an error", tc.in, id)
+			}
+			continue
+		}
+		if err != nil || id != tc.id {
+			t.Errorf("decoding %s returned %q, %v, want %q", tc.in, id, err, tc.id)
+			continue
+		}
+		out, err := json.Marshal(id)
+		if err != nil || string(out) != tc.out {
+			t.Errorf("encoding %q returned %s, %v, want %s", id, out, err, tc.out)
+		}
+	}
+}
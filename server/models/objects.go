@@ -3,11 +3,67 @@ package models
 import "time"
 
 type Object struct {
-	ID         int        `json:"id" db:"id"`
+	ID         ID         `json:"id" db:"id"`
 	LastSeenAt *time.Time `json:"last_seen_at" db:"last_seen_at"`
-	Online     bool       `json:"online" db:"-"`
+	Online     bool       `json:"online" db:"online"`
+	SeenCount  int64      `json:"seen_count" db:"seen_count"`
+	Label      *string    `json:"label,omitempty" db:"label"`
+	CreatedAt  *time.Time `json:"created_at,omitempty" db:"created_at"` // set by the first insert, read only
+}
+
+type ObjectRequest struct {
+	ID ID `json:"id"`
 }
 
 type ObjectsInput struct {
-	ObjectIDs []int `json:"object_ids"`
+	ObjectIDs []ID `json:"object_ids"`
+}
+
+type CallbackAccepted struct {
+	Enqueued int `json:"enqueued"` // ids handed to the pipeline, they are looked up asynchronously
+}
+
+type CallbackEcho struct {
+	BatchID   string `json:"batch_id"`
+	ObjectIDs []ID   `json:"object_ids"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+type HealthStatus struct {
+	Status string `json:"status"`
+}
+
+type ReadyStatus struct {
+	Status        string `json:"status"`
+	Database      string `json:"database"` // "ok" or the ping error
+	Started       bool   `json:"started"`  // pipeline goroutines are running
+	ColdStartDone bool   `json:"cold_start_done"`
+	TesterReached bool   `json:"tester_reached"`
+	Draining      bool   `json:"draining"` // shutting down soon, callbacks are refused
+}
+
+type PauseStatus struct {
+	Paused bool `json:"paused"`
+}
+
+type TimerDump struct {
+	Paused bool        `json:"paused"`
+	Timers []TimerInfo `json:"timers"`
+}
+
+type TimerInfo struct {
+	ID           ID        `json:"id"`
+	Deadline     time.Time `json:"deadline"`
+	RemainingSec float64   `json:"remaining_sec"`
+}
+
+type PipelineStatus struct {
+	Channels       map[string]int `json:"channels"`         // buffered items per channel
+	OldestQueuedAt *time.Time     `json:"oldest_queued_at"` // of ids still waiting for a tester lookup, null if none
+	LagSec         float64        `json:"lag_sec"`
+	ActiveWorkers  int64          `json:"active_workers"`
+	Timers         int            `json:"timers"`
 }
@@ -3,17 +3,34 @@ package postgres
 import (
 	"context"
 	"fmt"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/pkg/errors"
 	"github.com/poodbooq/bitburst_server/logger"
 	"github.com/poodbooq/bitburst_server/models"
 )
 
 type Postgres interface {
 	UpsertObject(ctx context.Context, obj models.Object) error
-	DeleteObjectByID(ctx context.Context, id int) error
+	UpsertObjects(ctx context.Context, objs []models.Object) error
+	UpsertObjectWithEvent(ctx context.Context, obj models.Object, kind string) error
+	WithTx(ctx context.Context, fn func(tx pgx.Tx) error) error
+	DeleteObjectByID(ctx context.Context, id models.ID) error
+	DeleteObjectsByIDs(ctx context.Context, ids []models.ID) (int64, error)
 	GetAll(ctx context.Context) ([]models.Object, error)
+	GetByID(ctx context.Context, id models.ID) (models.Object, error)
+	GetPage(ctx context.Context, limit, offset int) ([]models.Object, error)
+	GetPageBounds(ctx context.Context, size int) ([]models.ID, error)
+	GetRange(ctx context.Context, from, to models.ID) ([]models.Object, error)
+	Count(ctx context.Context) (int, error)
+	GetModifiedSince(ctx context.Context, since time.Time) ([]models.Object, error)
+	ClaimExpired(ctx context.Context, before time.Time, limit int, lockTTL time.Duration) ([]models.Object, error)
+	ListenDeletes(ctx context.Context, channel string, handle func(id models.ID)) error
+	Ping(ctx context.Context) error
 }
 
 type Config struct {
@@ -24,41 +41,76 @@ type Config struct {
 	PoolMaxConnections int
 	Database           string
 	SSLMode            string
+
+	HealthCheckPeriodSec int  // how often idle connections are checked, 0 keeps the pgx default
+	PingBeforeAcquire    bool // validate connections before handing them out, catching stale ones after a failover
+	AcquireTimeoutMs     int  // writes fail with ErrPoolExhausted after waiting this long for a connection, 0 waits as long as their context allows
 }
 
 type postgres struct {
-	pg  *pgxpool.Pool
-	log logger.Logger
+	pg             *pgxpool.Pool
+	log            logger.Logger
+	acquireTimeout time.Duration
 }
 
 var (
 	singleton *postgres
-	once      = new(sync.Once)
+	mu        = new(sync.Mutex)
+
+	ErrObjectNotFound = errors.New("object not found")
+	ErrPoolExhausted  = errors.New("no postgres connection available in time, pool exhausted")
 )
 
+// Load connects on the first successful call and returns the same instance afterwards.
+// A failed connection attempt is not cached, so a later call can succeed once the database is up.
 func Load(ctx context.Context, cfg Config, log logger.Logger) (*postgres, error) {
-	var err error
-	once.Do(func() {
-		singleton = new(postgres)
-		var (
-			poolConfig *pgxpool.Config
-			pool       *pgxpool.Pool
-		)
-		poolConfig, err = pgxpool.ParseConfig(getPgUrl(cfg))
-		if err != nil {
-			log.Error(err)
-			return
-		}
-		pool, err = pgxpool.ConnectConfig(ctx, poolConfig)
-		if err != nil {
-			log.Error(err)
-			return
-		}
+	mu.Lock()
+	defer mu.Unlock()
+	if singleton != nil {
+		return singleton, nil
+	}
+	poolConfig, err := newPoolConfig(cfg, log)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	pool, err := pgxpool.ConnectConfig(ctx, poolConfig)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
 
-		singleton.pg = pool
-		singleton.log = log
-	})
-	return singleton, err
+	singleton = &postgres{
+		pg:             pool,
+		log:            log,
+		acquireTimeout: time.Duration(cfg.AcquireTimeoutMs) * time.Millisecond,
+	}
+	return singleton, nil
+}
+
+func newPoolConfig(cfg Config, log logger.Logger) (*pgxpool.Config, error) {
+	poolConfig, err := pgxpool.ParseConfig(getPgUrl(cfg))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.HealthCheckPeriodSec > 0 {
+		poolConfig.HealthCheckPeriod = time.Duration(cfg.HealthCheckPeriodSec) * time.Second
+	}
+	if cfg.PingBeforeAcquire {
+		poolConfig.BeforeAcquire = pingBeforeAcquire(log)
+	}
+	return poolConfig, nil
+}
+
+// pingBeforeAcquire makes the pool destroy connections that fail a ping and try another one
+func pingBeforeAcquire(log logger.Logger) func(ctx context.Context, conn *pgx.Conn) bool {
+	return func(ctx context.Context, conn *pgx.Conn) bool {
+		if err := conn.Ping(ctx); err != nil {
+			log.Warn("discarding stale postgres connection: %v", err)
+			return false
+		}
+		return true
+	}
 }
 
 func getPgUrl(cfg Config) string {
@@ -78,29 +130,313 @@ func (p *postgres) Close() error {
 	return nil
 }
 
+// acquire waits at most acquireTimeout for a pooled connection, reporting ErrPoolExhausted
+// when none freed up in time while ctx itself is still alive
+func (p *postgres) acquire(ctx context.Context) (*pgxpool.Conn, error) {
+	if p.acquireTimeout <= 0 {
+		return p.pg.Acquire(ctx)
+	}
+	acquireCtx, cancel := context.WithTimeout(ctx, p.acquireTimeout)
+	defer cancel()
+	conn, err := p.pg.Acquire(acquireCtx)
+	if err != nil && ctx.Err() == nil && acquireCtx.Err() == context.DeadlineExceeded {
+		return nil, ErrPoolExhausted
+	}
+	return conn, err
+}
+
+// last_seen_at never moves backwards, so a late write of an older observation can't undo a newer one.
+// A missing label keeps the stored one.
+const upsertObjectQuery = "INSERT INTO objects (id, last_seen_at, seen_count, online, label) VALUES ($1, $2, 1, $3, $4) ON CONFLICT (id) DO UPDATE SET last_seen_at = GREATEST(objects.last_seen_at, $2), seen_count = objects.seen_count + 1, online = $3, label = COALESCE($4, objects.label)"
+
 func (p *postgres) UpsertObject(ctx context.Context, obj models.Object) error {
-	_, err := p.pg.Exec(ctx, "INSERT INTO objects (id, last_seen_at) VALUES ($1, $2) ON CONFLICT (id) DO UPDATE SET last_seen_at = $2", obj.ID, obj.LastSeenAt)
+	conn, err := p.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	_, err = conn.Exec(ctx, upsertObjectQuery, string(obj.ID), obj.LastSeenAt, obj.Online, obj.Label)
 	return err
 }
 
-func (p *postgres) DeleteObjectByID(ctx context.Context, id int) error {
-	_, err := p.pg.Exec(ctx, `DELETE FROM objects WHERE id = $1`, id)
-	return err
+// UpsertObjects upserts all objs in one round trip. The batch runs in a single implicit
+// transaction, so either all of them are written or none.
+func (p *postgres) UpsertObjects(ctx context.Context, objs []models.Object) error {
+	conn, err := p.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	batch := new(pgx.Batch)
+	for _, obj := range objs {
+		batch.Queue(upsertObjectQuery, string(obj.ID), obj.LastSeenAt, obj.Online, obj.Label)
+	}
+	results := conn.SendBatch(ctx, batch)
+	for range objs {
+		if _, err = results.Exec(); err != nil {
+			_ = results.Close()
+			return err
+		}
+	}
+	return results.Close()
+}
+
+// UpsertObjectWithEvent upserts obj and records an event of kind for it atomically, leaving neither row if one fails
+func (p *postgres) UpsertObjectWithEvent(ctx context.Context, obj models.Object, kind string) error {
+	return p.WithTx(ctx, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, upsertObjectQuery, string(obj.ID), obj.LastSeenAt, obj.Online, obj.Label); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, "INSERT INTO object_events (object_id, kind, at) VALUES ($1, $2, $3)", string(obj.ID), kind, obj.LastSeenAt)
+		return err
+	})
+}
+
+// WithTx runs fn in a transaction, committing it when fn succeeds and rolling it back otherwise
+func (p *postgres) WithTx(ctx context.Context, fn func(tx pgx.Tx) error) error {
+	conn, err := p.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := tx.Rollback(ctx); err != nil && err != pgx.ErrTxClosed {
+			p.log.Error(err)
+		}
+	}()
+	if err = fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// DeleteObjectByID returns ErrObjectNotFound when there was no row to delete
+func (p *postgres) DeleteObjectByID(ctx context.Context, id models.ID) error {
+	conn, err := p.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	tag, err := conn.Exec(ctx, `DELETE FROM objects WHERE id = $1`, string(id))
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrObjectNotFound
+	}
+	return nil
+}
+
+// DeleteObjectsByIDs returns how many of the ids had a row to delete
+func (p *postgres) DeleteObjectsByIDs(ctx context.Context, ids []models.ID) (int64, error) {
+	conn, err := p.acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+	tag, err := conn.Exec(ctx, `DELETE FROM objects WHERE id = ANY($1)`, idStrings(ids))
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
 }
 
 func (p *postgres) GetAll(ctx context.Context) (objects []models.Object, err error) {
-	rows, err := p.pg.Query(ctx, "SELECT id, last_seen_at FROM objects")
+	rows, err := p.pg.Query(ctx, "SELECT id, last_seen_at, seen_count, online, label, created_at FROM objects")
 	if err != nil {
 		return nil, err
 	}
+	return scanObjects(rows)
+}
+
+// GetByID returns ErrObjectNotFound when there is no row for id
+func (p *postgres) GetByID(ctx context.Context, id models.ID) (models.Object, error) {
+	rows, err := p.pg.Query(ctx, "SELECT id, last_seen_at, seen_count, online, label, created_at FROM objects WHERE id = $1", string(id))
+	if err != nil {
+		return models.Object{}, err
+	}
+	objs, err := scanObjects(rows)
+	if err != nil {
+		return models.Object{}, err
+	}
+	if len(objs) == 0 {
+		return models.Object{}, ErrObjectNotFound
+	}
+	return objs[0], nil
+}
+
+// GetPage returns up to limit objects ordered by id, skipping the first offset of them.
+// Shorter ids sort first, so integer ids keep their numeric order.
+func (p *postgres) GetPage(ctx context.Context, limit, offset int) ([]models.Object, error) {
+	rows, err := p.pg.Query(ctx, "SELECT id, last_seen_at, seen_count, online, label, created_at FROM objects ORDER BY length(id), id LIMIT $1 OFFSET $2", limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	return scanObjects(rows)
+}
+
+// GetPageBounds returns the first id of every page of size objects in id order.
+// Readers splitting the table at these ids cover every row exactly once,
+// even while rows are deleted under them.
+func (p *postgres) GetPageBounds(ctx context.Context, size int) ([]models.ID, error) {
+	rows, err := p.pg.Query(ctx, `
+SELECT id FROM (
+	SELECT id, row_number() OVER (ORDER BY length(id), id) AS n FROM objects
+) numbered
+WHERE (n - 1) % $1 = 0
+ORDER BY length(id), id`, size)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var bounds []models.ID
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		bounds = append(bounds, models.ID(id))
+	}
+	return bounds, rows.Err()
+}
+
+// GetRange returns objects from id from up to, but not including, id to in id order.
+// An empty to leaves the range open at the end.
+func (p *postgres) GetRange(ctx context.Context, from, to models.ID) ([]models.Object, error) {
+	rows, err := p.pg.Query(ctx, `
+SELECT id, last_seen_at, seen_count, online, label, created_at FROM objects
+WHERE (length(id), id) >= (length($1::text), $1::text)
+	AND ($2::text = '' OR (length(id), id) < (length($2::text), $2::text))
+ORDER BY length(id), id`, string(from), string(to))
+	if err != nil {
+		return nil, err
+	}
+	return scanObjects(rows)
+}
+
+// claimExpiredQuery claims up to $2 objects last seen before $1 that no other instance holds a claim on,
+// skipping rows a concurrent claimer has locked instead of waiting for them
+const claimExpiredQuery = `
+UPDATE objects SET claimed_until = now() + $3 * interval '1 millisecond'
+WHERE id IN (
+	SELECT id FROM objects
+	WHERE last_seen_at < $1 AND (claimed_until IS NULL OR claimed_until < now())
+	ORDER BY last_seen_at
+	LIMIT $2
+	FOR UPDATE SKIP LOCKED
+)
+RETURNING id, last_seen_at, seen_count, online, label, created_at`
+
+// ClaimExpired claims objects last seen before before for lockTTL, so service instances sharing
+// the database split expiration work without processing the same object twice. A claim lapses
+// after lockTTL, handing the object to whoever claims next if it wasn't deleted in time.
+func (p *postgres) ClaimExpired(ctx context.Context, before time.Time, limit int, lockTTL time.Duration) ([]models.Object, error) {
+	conn, err := p.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	rows, err := conn.Query(ctx, claimExpiredQuery, before, limit, lockTTL.Milliseconds())
+	if err != nil {
+		return nil, err
+	}
+	return scanObjects(rows)
+}
+
+// GetModifiedSince returns objects last seen at or after since, oldest first
+func (p *postgres) GetModifiedSince(ctx context.Context, since time.Time) ([]models.Object, error) {
+	rows, err := p.pg.Query(ctx, "SELECT id, last_seen_at, seen_count, online, label, created_at FROM objects WHERE last_seen_at >= $1 ORDER BY last_seen_at, id", since)
+	if err != nil {
+		return nil, err
+	}
+	return scanObjects(rows)
+}
 
+// Ping checks a pooled connection can still reach the database
+func (p *postgres) Ping(ctx context.Context) error {
+	conn, err := p.pg.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	return conn.Conn().Ping(ctx)
+}
+
+func (p *postgres) Count(ctx context.Context) (n int, err error) {
+	err = p.pg.QueryRow(ctx, "SELECT count(*) FROM objects").Scan(&n)
+	return n, err
+}
+
+func idStrings(ids []models.ID) []string {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = string(id)
+	}
+	return strs
+}
+
+func scanObjects(rows pgx.Rows) (objects []models.Object, err error) {
+	defer rows.Close()
 	for rows.Next() {
-		var obj models.Object
-		err = rows.Scan(&obj.ID, &obj.LastSeenAt)
+		var (
+			obj models.Object
+			id  string
+		)
+		err = rows.Scan(&id, &obj.LastSeenAt, &obj.SeenCount, &obj.Online, &obj.Label, &obj.CreatedAt)
 		if err != nil {
 			return nil, err
 		}
+		obj.ID = models.ID(id)
+		if obj.LastSeenAt != nil { // timestamptz comes back in the session time zone, the service works in UTC
+			utc := obj.LastSeenAt.UTC()
+			obj.LastSeenAt = &utc
+		}
+		if obj.CreatedAt != nil {
+			utc := obj.CreatedAt.UTC()
+			obj.CreatedAt = &utc
+		}
 		objects = append(objects, obj)
 	}
-	return objects, nil
+	return objects, rows.Err()
+}
+
+// ListenDeletes blocks on a dedicated connection, calling handle with the id sent as payload
+// of every NOTIFY on channel until ctx is done or the connection fails
+func (p *postgres) ListenDeletes(ctx context.Context, channel string, handle func(id models.ID)) error {
+	conn, err := p.pg.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// the connection goes back to the pool, so it must stop listening first.
+		// ctx is usually done by now, so unlisten under a context of its own.
+		unlistenCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if !conn.Conn().IsClosed() {
+			if _, err := conn.Exec(unlistenCtx, "UNLISTEN *"); err != nil {
+				conn.Conn().Close(unlistenCtx) // a closed connection is dropped from the pool on release
+			}
+		}
+		conn.Release()
+	}()
+
+	if _, err = conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+		return err
+	}
+	for {
+		notification, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		id := strings.TrimSpace(notification.Payload)
+		if id == "" {
+			p.log.Error(errors.Errorf("empty payload on channel %s", channel))
+			continue
+		}
+		handle(models.ID(id))
+	}
 }
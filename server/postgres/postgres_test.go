@@ -0,0 +1,420 @@
+package postgres
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/poodbooq/bitburst_server/logger"
+	"github.com/poodbooq/bitburst_server/models"
+)
+
+// schema mirrors the tables init.sh creates
+const schema = `
+CREATE TABLE IF NOT EXISTS objects (
+	id              TEXT         PRIMARY KEY,
+	last_seen_at    TIMESTAMPTZ(6),
+	seen_count      BIGINT       NOT NULL DEFAULT 0,
+	online          BOOLEAN      NOT NULL DEFAULT TRUE,
+	label           TEXT,
+	claimed_until   TIMESTAMPTZ(6),
+	created_at      TIMESTAMPTZ(6) DEFAULT now()
+);
+CREATE TABLE IF NOT EXISTS object_events (
+	id              BIGSERIAL    PRIMARY KEY,
+	object_id       TEXT         NOT NULL,
+	kind            TEXT         NOT NULL,
+	at              TIMESTAMPTZ(6)
+);`
+
+type testLogger struct {
+	t *testing.T
+}
+
+func (l testLogger) Warn(msg string, args ...interface{})  { l.t.Logf("WARN "+msg, args...) }
+func (l testLogger) Info(msg string, args ...interface{})  { l.t.Logf("INFO "+msg, args...) }
+func (l testLogger) Debug(msg string, args ...interface{}) { l.t.Logf("DEBUG "+msg, args...) }
+func (l testLogger) Error(err error, keysAndValues ...interface{}) {
+	l.t.Log(append([]interface{}{"ERROR", err}, keysAndValues...)...)
+}
+func (l testLogger) With(key string, value interface{}) logger.Logger { return l }
+
+// testPostgres connects to the database TEST_POSTGRES_DSN points at, skipping the test without one,
+// and empties the tables the test works on
+func testPostgres(t *testing.T) *postgres {
+	t.Helper()
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("TEST_POSTGRES_DSN not set, skipping database test")
+	}
+	ctx := context.Background()
+	pool, err := pgxpool.Connect(ctx, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	if _, err = pool.Exec(ctx, schema); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = pool.Exec(ctx, "TRUNCATE objects, object_events"); err != nil {
+		t.Fatal(err)
+	}
+	return &postgres{pg: pool, log: testLogger{t}}
+}
+
+func TestClaimExpiredGivesConcurrentClaimersDisjointSets(t *testing.T) {
+	p := testPostgres(t)
+	ctx := context.Background()
+	now := time.Now().UTC()
+	expired, fresh := now.Add(-time.Hour), now
+	for i := 1; i <= 60; i++ {
+		seen := expired
+		if i > 50 {
+			seen = fresh
+		}
+		if err := p.UpsertObject(ctx, models.Object{ID: models.ID(strconv.Itoa(i)), LastSeenAt: &seen, Online: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var (
+		wg      sync.WaitGroup
+		start   = make(chan struct{})
+		claims  [2][]models.Object
+		errs    [2]error
+		before  = now.Add(-time.Minute)
+		lockTTL = time.Minute
+	)
+	for c := range claims {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			<-start
+			for {
+				objs, err := p.ClaimExpired(ctx, before, 7, lockTTL)
+				if err != nil {
+					errs[c] = err
+					return
+				}
+				if len(objs) == 0 {
+					return
+				}
+				claims[c] = append(claims[c], objs...)
+			}
+		}(c)
+	}
+	close(start)
+	wg.Wait()
+
+	seen := make(map[models.ID]int)
+	for c := range claims {
+		if errs[c] != nil {
+			t.Fatalf("claimer %v: %v", c, errs[c])
+		}
+		for _, obj := range claims[c] {
+			if _, dup := seen[obj.ID]; dup {
+				t.Errorf("object %v claimed by claimer %v and claimer %v", obj.ID, seen[obj.ID], c)
+			}
+			seen[obj.ID] = c
+		}
+	}
+	for i := 1; i <= 60; i++ {
+		id := models.ID(strconv.Itoa(i))
+		if _, claimed := seen[id]; claimed != (i <= 50) {
+			t.Errorf("object %v claimed=%v, want %v", id, claimed, i <= 50)
+		}
+	}
+	if again, err := p.ClaimExpired(ctx, before, 100, lockTTL); err != nil || len(again) != 0 {
+		t.Errorf("claims didn't hold for their TTL: reclaimed %v, %v", len(again), err)
+	}
+}
+
+func TestClaimExpiredClaimLapses(t *testing.T) {
+	p := testPostgres(t)
+	ctx := context.Background()
+	seen := time.Now().UTC().Add(-time.Hour)
+	if err := p.UpsertObject(ctx, models.Object{ID: "1", LastSeenAt: &seen, Online: true}); err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now().UTC()
+	if objs, err := p.ClaimExpired(ctx, before, 10, 50*time.Millisecond); err != nil || len(objs) != 1 {
+		t.Fatalf("first claim returned %v objects, %v", len(objs), err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	objs, err := p.ClaimExpired(ctx, before, 10, time.Minute)
+	if err != nil || len(objs) != 1 {
+		t.Fatalf("claim after the TTL lapsed returned %v objects, %v", len(objs), err)
+	}
+	if objs[0].ID != "1" {
+		t.Fatalf("reclaimed %v, want 1", objs[0].ID)
+	}
+}
+
+func TestPoolConfigHealthOptions(t *testing.T) {
+	cfg := Config{Host: "localhost", Port: "5432", User: "postgres", Database: "bitburst", SSLMode: "disable", PoolMaxConnections: 4}
+	poolConfig, err := newPoolConfig(cfg, testLogger{t})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if poolConfig.BeforeAcquire != nil {
+		t.Error("before-acquire ping set without PingBeforeAcquire")
+	}
+	defaultPeriod := poolConfig.HealthCheckPeriod
+
+	cfg.PingBeforeAcquire, cfg.HealthCheckPeriodSec = true, 7
+	if poolConfig, err = newPoolConfig(cfg, testLogger{t}); err != nil {
+		t.Fatal(err)
+	}
+	if poolConfig.BeforeAcquire == nil {
+		t.Error("PingBeforeAcquire didn't set the before-acquire hook")
+	}
+	if poolConfig.HealthCheckPeriod != 7*time.Second || poolConfig.HealthCheckPeriod == defaultPeriod {
+		t.Errorf("health check period is %v, want 7s", poolConfig.HealthCheckPeriod)
+	}
+}
+
+func TestFailedLoadIsRetried(t *testing.T) {
+	reset := func() {
+		mu.Lock()
+		singleton = nil
+		mu.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	down := Config{Host: "127.0.0.1", Port: "1", User: "postgres", Database: "bitburst", SSLMode: "disable", PoolMaxConnections: 1}
+	for i := 0; i < 2; i++ {
+		if p, err := Load(ctx, down, testLogger{t}); err == nil || p != nil {
+			t.Fatalf("Load #%v against a closed port returned %v, %v, want an error", i+1, p, err)
+		}
+	}
+
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("TEST_POSTGRES_DSN not set, skipping the successful retry")
+	}
+	connCfg, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := Config{
+		Host:               connCfg.Host,
+		Port:               strconv.Itoa(int(connCfg.Port)),
+		User:               connCfg.User,
+		Password:           connCfg.Password,
+		Database:           connCfg.Database,
+		SSLMode:            "disable",
+		PoolMaxConnections: 1,
+	}
+	first, err := Load(ctx, up, testLogger{t})
+	if err != nil {
+		t.Fatalf("Load once the database is up failed: %v", err)
+	}
+	defer first.Close()
+	if second, err := Load(ctx, down, testLogger{t}); err != nil || second != first {
+		t.Fatalf("Load after a successful one returned %p, %v, want the cached %p", second, err, first)
+	}
+}
+
+func TestDeletesReportMissingRows(t *testing.T) {
+	p := testPostgres(t)
+	ctx := context.Background()
+	seen := time.Now().UTC()
+	for _, id := range []models.ID{"1", "2"} {
+		if err := p.UpsertObject(ctx, models.Object{ID: id, LastSeenAt: &seen, Online: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := p.DeleteObjectByID(ctx, "1"); err != nil {
+		t.Fatalf("deleting a stored object: %v", err)
+	}
+	if err := p.DeleteObjectByID(ctx, "1"); err != ErrObjectNotFound {
+		t.Fatalf("deleting it again returned %v, want %v", err, ErrObjectNotFound)
+	}
+	n, err := p.DeleteObjectsByIDs(ctx, []models.ID{"1", "2", "3"})
+	if err != nil || n != 1 {
+		t.Fatalf("batch delete of one stored and two missing ids returned %v, %v, want 1", n, err)
+	}
+}
+
+func TestUpsertCountsSightings(t *testing.T) {
+	p := testPostgres(t)
+	ctx := context.Background()
+	for i := 1; i <= 3; i++ {
+		seen := time.Now().UTC()
+		if err := p.UpsertObject(ctx, models.Object{ID: "1", LastSeenAt: &seen, Online: true}); err != nil {
+			t.Fatal(err)
+		}
+		obj, err := p.GetByID(ctx, "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obj.SeenCount != int64(i) {
+			t.Fatalf("seen_count is %v after %v upserts", obj.SeenCount, i)
+		}
+	}
+}
+
+func TestGetModifiedSinceIncludesBoundary(t *testing.T) {
+	p := testPostgres(t)
+	ctx := context.Background()
+	since := time.Now().UTC().Truncate(time.Microsecond) // the precision of timestamptz
+	for id, seen := range map[models.ID]time.Time{
+		"before": since.Add(-time.Microsecond),
+		"at":     since,
+		"after":  since.Add(time.Microsecond),
+	} {
+		seen := seen
+		if err := p.UpsertObject(ctx, models.Object{ID: id, LastSeenAt: &seen, Online: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	objs, err := p.GetModifiedSince(ctx, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 2 || objs[0].ID != "at" || objs[1].ID != "after" {
+		t.Fatalf("GetModifiedSince(%v) returned %+v, want at and after, oldest first", since, objs)
+	}
+	if objs, err = p.GetModifiedSince(ctx, since.Add(2*time.Microsecond)); err != nil || len(objs) != 0 {
+		t.Fatalf("GetModifiedSince past every object returned %+v, %v", objs, err)
+	}
+}
+
+func TestUpsertWithEventRollsBackWhenEventFails(t *testing.T) {
+	p := testPostgres(t)
+	ctx := context.Background()
+	if _, err := p.pg.Exec(ctx, "ALTER TABLE object_events ADD CONSTRAINT test_kind CHECK (kind <> 'rejected')"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _, _ = p.pg.Exec(ctx, "ALTER TABLE object_events DROP CONSTRAINT IF EXISTS test_kind") })
+	countRows := func(table string) (n int) {
+		t.Helper()
+		if err := p.pg.QueryRow(ctx, "SELECT count(*) FROM "+table).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	seen := time.Now().UTC()
+	if err := p.UpsertObjectWithEvent(ctx, models.Object{ID: "1", LastSeenAt: &seen, Online: true}, "rejected"); err == nil {
+		t.Fatal("event insert violating a constraint succeeded")
+	}
+	if objects, events := countRows("objects"), countRows("object_events"); objects != 0 || events != 0 {
+		t.Fatalf("failed event left %v objects and %v events, want neither", objects, events)
+	}
+
+	if err := p.UpsertObjectWithEvent(ctx, models.Object{ID: "1", LastSeenAt: &seen, Online: true}, "online"); err != nil {
+		t.Fatal(err)
+	}
+	if objects, events := countRows("objects"), countRows("object_events"); objects != 1 || events != 1 {
+		t.Fatalf("committed upsert left %v objects and %v events, want one of each", objects, events)
+	}
+}
+
+func TestLastSeenAtKeepsMicroseconds(t *testing.T) {
+	p := testPostgres(t)
+	ctx := context.Background()
+	seen := time.Date(2021, 3, 1, 12, 0, 0, 123456000, time.UTC)
+	if err := p.UpsertObject(ctx, models.Object{ID: "1", LastSeenAt: &seen, Online: true}); err != nil {
+		t.Fatal(err)
+	}
+	earlier := seen.Add(-time.Microsecond) // GREATEST must tell the two apart
+	if err := p.UpsertObject(ctx, models.Object{ID: "1", LastSeenAt: &earlier, Online: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	objs, err := p.GetAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 1 || objs[0].LastSeenAt == nil || !objs[0].LastSeenAt.Equal(seen) {
+		t.Fatalf("GetAll returned %+v, want last_seen_at %v", objs, seen.Format(time.RFC3339Nano))
+	}
+	obj, err := p.GetByID(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !obj.LastSeenAt.Equal(seen) {
+		t.Fatalf("GetByID returned last_seen_at %v, want %v", obj.LastSeenAt.Format(time.RFC3339Nano), seen.Format(time.RFC3339Nano))
+	}
+}
+
+func TestTinyPoolReportsExhaustion(t *testing.T) {
+	testPostgres(t) // skips without a database, creates the schema otherwise
+	ctx := context.Background()
+	poolCfg, err := pgxpool.ParseConfig(os.Getenv("TEST_POSTGRES_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	poolCfg.MaxConns = 1
+	pool, err := pgxpool.ConnectConfig(ctx, poolCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	p := &postgres{pg: pool, log: testLogger{t}, acquireTimeout: 50 * time.Millisecond}
+
+	held, err := pool.Acquire(ctx) // the only connection, as if a slow write held it
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := time.Now().UTC()
+	if err = p.UpsertObject(ctx, models.Object{ID: "1", LastSeenAt: &seen, Online: true}); err != ErrPoolExhausted {
+		t.Fatalf("upsert on an exhausted pool returned %v, want %v", err, ErrPoolExhausted)
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err = p.UpsertObject(cancelled, models.Object{ID: "1", LastSeenAt: &seen, Online: true}); err == ErrPoolExhausted {
+		t.Fatal("a cancelled context reported as pool exhaustion")
+	}
+	held.Release()
+	if err = p.UpsertObject(ctx, models.Object{ID: "1", LastSeenAt: &seen, Online: true}); err != nil {
+		t.Fatalf("upsert after the connection freed up: %v", err)
+	}
+}
+
+func TestLabelRoundTrip(t *testing.T) {
+	p := testPostgres(t)
+	ctx := context.Background()
+	seen := time.Now().UTC()
+	label := "boiler room"
+	if err := p.UpsertObject(ctx, models.Object{ID: "1", LastSeenAt: &seen, Online: true, Label: &label}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.UpsertObject(ctx, models.Object{ID: "2", LastSeenAt: &seen, Online: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.UpsertObject(ctx, models.Object{ID: "1", LastSeenAt: &seen, Online: true}); err != nil { // a later response without one
+		t.Fatal(err)
+	}
+
+	obj, err := p.GetByID(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Label == nil || *obj.Label != label {
+		t.Fatalf("label of object 1 is %v, want %q kept from the first upsert", obj.Label, label)
+	}
+	if obj, err = p.GetByID(ctx, "2"); err != nil || obj.Label != nil {
+		t.Fatalf("object without a label read as %v, %v", obj.Label, err)
+	}
+	objs, err := p.GetAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, obj := range objs {
+		if hasLabel := obj.Label != nil; hasLabel != (obj.ID == "1") {
+			t.Errorf("GetAll read object %v with label %v", obj.ID, obj.Label)
+		}
+	}
+}
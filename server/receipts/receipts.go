@@ -0,0 +1,47 @@
+package receipts
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/poodbooq/bitburst_server/models"
+	"github.com/poodbooq/bitburst_server/webhook"
+)
+
+// Receipt records that an object was deleted, why and on whose behalf
+type Receipt struct {
+	ObjectID  models.ID `json:"object_id"`
+	Reason    string    `json:"reason"`
+	DeletedAt time.Time `json:"deleted_at"`
+	Actor     string    `json:"actor"` // "service" for deletes the service decided on, "external" for ones requested from outside
+}
+
+type Sink interface {
+	Emit(ctx context.Context, receipt Receipt) error
+}
+
+type noop struct{}
+
+func NewNoop() Sink {
+	return noop{}
+}
+
+func (noop) Emit(context.Context, Receipt) error {
+	return nil
+}
+
+type httpSink struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTP returns a sink POSTing each receipt to url as JSON, so an audit service can record deletes
+func NewHTTP(url string, client *http.Client) Sink {
+	return &httpSink{url: url, client: client}
+}
+
+func (s *httpSink) Emit(ctx context.Context, receipt Receipt) error {
+	return errors.Wrapf(webhook.PostJSON(ctx, s.client, s.url, receipt), "emitting deletion receipt for id %v", receipt.ObjectID)
+}
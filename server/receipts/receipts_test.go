@@ -0,0 +1,47 @@
+package receipts
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPSinkPostsReceipts(t *testing.T) {
+	deletedAt := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	received := make(chan Receipt, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("receipt sent as %s with content type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		var receipt Receipt
+		if err := json.NewDecoder(r.Body).Decode(&receipt); err != nil {
+			t.Error(err)
+		}
+		received <- receipt
+	}))
+	defer srv.Close()
+
+	want := Receipt{ObjectID: "42", Reason: "offline", DeletedAt: deletedAt, Actor: "service"}
+	if err := NewHTTP(srv.URL, srv.Client()).Emit(context.Background(), want); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; got != want {
+		t.Fatalf("sink received %+v, want %+v", got, want)
+	}
+}
+
+func TestHTTPSinkReportsRejectedReceipts(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "audit log full", http.StatusInsufficientStorage)
+	}))
+	defer srv.Close()
+
+	err := NewHTTP(srv.URL, srv.Client()).Emit(context.Background(), Receipt{ObjectID: "42"})
+	if err == nil || !strings.Contains(err.Error(), "emitting deletion receipt for id 42") || !strings.Contains(err.Error(), "507") {
+		t.Fatalf("rejected receipt returned %v", err)
+	}
+}
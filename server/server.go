@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/poodbooq/bitburst_server/config"
 	"github.com/poodbooq/bitburst_server/logger"
@@ -22,7 +24,8 @@ func main() {
 	}
 	log, err := logger.Get(cfg.Logger)
 	if err != nil {
-		return
+		log.Error(err)
+		log.Warn("falling back to the standard library logger")
 	}
 	defer func() {
 		if err := log.Close(); err != nil {
@@ -40,12 +43,29 @@ func main() {
 		}
 	}()
 
-	go service.
-		Load(database, log, cfg.Service).
-		Run(ctx)
+	srv, err := service.Load(database, log, cfg.Service)
+	if err != nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := srv.Run(ctx); err != nil {
+			log.Error(err)
+		}
+	}()
 
 	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, os.Interrupt, os.Kill)
-	<-sig
+	signal.Notify(sig, os.Interrupt, os.Kill, syscall.SIGTERM)
+	if s := <-sig; s == syscall.SIGTERM && cfg.Service.DrainDelaySec > 0 {
+		log.Info("draining for %vs before shutting down", cfg.Service.DrainDelaySec)
+		srv.Drain()
+		select {
+		case <-sig: // a second signal skips the rest of the delay
+		case <-time.After(time.Duration(cfg.Service.DrainDelaySec) * time.Second):
+		}
+	}
 	fmt.Println("closing")
+	cancel()
+	<-done // Run returns once drained, or with an error when the shutdown grace period ran out
 }
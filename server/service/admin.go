@@ -0,0 +1,124 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/poodbooq/bitburst_server/logger"
+	"github.com/poodbooq/bitburst_server/models"
+)
+
+func (s *service) handleAdminRoutes(ctx context.Context) {
+	timeout := s.cfg.HTTP.AdminTimeoutMs
+	if s.cfg.ExposeConfig {
+		s.router.GET("/config", withTimeout(timeout, func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+			s.writeJSON(w, http.StatusOK, redactConfig(s.cfg))
+		}))
+	}
+	if !s.cfg.DebugEndpoints { // anyone reaching the rest can stop expiration, load the database or flood the logs
+		return
+	}
+	s.router.POST("/pause", withTimeout(timeout, func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+		stopped := s.timers.pause()
+		s.log.Info("paused expiration timers, %v stopped", stopped)
+		s.writeJSON(w, http.StatusOK, models.PauseStatus{Paused: true})
+	}))
+	s.router.POST("/resume", withTimeout(timeout, func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+		s.timers.mu.Lock()
+		wasPaused := s.timers.paused
+		s.timers.paused = false
+		s.timers.mu.Unlock()
+		if wasPaused {
+			s.work.spawn(func() { s.rearmTimers(ctx) })
+		}
+		s.writeJSON(w, http.StatusOK, models.PauseStatus{Paused: false})
+	}))
+	s.router.POST("/resync", withTimeout(timeout, func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+		if !s.beginReconcile() {
+			s.writeError(w, http.StatusConflict, "cold start or resync already running")
+			return
+		}
+		if !s.work.spawn(func() {
+			defer s.endReconcile()
+			s.reconcileStored(ctx)
+			s.log.Info("resync of stored objects finished")
+		}) {
+			s.endReconcile()
+			s.writeError(w, http.StatusServiceUnavailable, "shutting down")
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	if leveled, ok := s.log.(logger.LevelHandler); ok { // changing the level without a restart, e.g. debug logs in production for a while
+		level := leveled.LevelHandler()
+		s.router.Handler(http.MethodGet, "/log/level", level)
+		s.router.Handler(http.MethodPut, "/log/level", level)
+	}
+	s.router.GET("/debug/timers", withTimeout(timeout, func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+		s.writeJSON(w, http.StatusOK, s.timers.dump(s.clock.Now()))
+	}))
+}
+
+const redacted = "REDACTED"
+
+// redactConfig returns cfg with the credentials URLs may carry masked, safe to show to operators
+func redactConfig(cfg Config) Config {
+	cfg.EventsURL = redactURL(cfg.EventsURL)
+	cfg.ReceiptsURL = redactURL(cfg.ReceiptsURL)
+	cfg.BackfillSource = redactURL(cfg.BackfillSource)
+	return cfg
+}
+
+// redactURL masks the user info and query of raw, where tokens usually travel. Anything
+// that doesn't parse as a URL with a scheme, like a file path, is returned unchanged.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme == "" {
+		return raw
+	}
+	if u.User != nil {
+		u.User = url.User(redacted)
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = redacted
+	}
+	return u.String()
+}
+
+// dump snapshots every armed timer with its deadline and the time left until it, soonest first
+func (t *timer) dump(now time.Time) models.TimerDump {
+	t.mu.Lock()
+	dump := models.TimerDump{Paused: t.paused, Timers: make([]models.TimerInfo, 0, len(t.byID))}
+	for id, entry := range t.byID {
+		dump.Timers = append(dump.Timers, models.TimerInfo{
+			ID:           id,
+			Deadline:     entry.deadline,
+			RemainingSec: entry.deadline.Sub(now).Seconds(),
+		})
+	}
+	t.mu.Unlock()
+	sort.Slice(dump.Timers, func(i, j int) bool { return dump.Timers[i].Deadline.Before(dump.Timers[j].Deadline) })
+	return dump
+}
+
+// rearmTimers tracks expiration of every stored object again, counting from its last_seen_at.
+// Objects whose retention ran out while paused get a full retention period instead of being deleted at once.
+func (s *service) rearmTimers(ctx context.Context) {
+	objs, err := s.database.GetAll(ctx)
+	if err != nil {
+		s.log.Error(err)
+		return
+	}
+	for i := range objs {
+		select {
+		case <-ctx.Done():
+			return
+		case s.expirationCh <- objs[i]:
+		}
+	}
+	s.log.Info("resumed expiration timers for %v objects", len(objs))
+}
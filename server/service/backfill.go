@@ -0,0 +1,71 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/poodbooq/bitburst_server/models"
+)
+
+// backfill feeds the ids listed in BackfillSource through the pipeline once at startup,
+// so their state is fetched from the tester as if they had been received by a callback
+func (s *service) backfill(ctx context.Context) {
+	src, err := s.openBackfillSource(ctx)
+	if err != nil {
+		s.log.Error(errors.Wrapf(err, "opening backfill source %s", s.cfg.BackfillSource))
+		return
+	}
+	defer src.Close()
+
+	var (
+		n       int
+		scanner = bufio.NewScanner(src)
+	)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id := models.ID(line)
+		if err := validateID(id, s.cfg.StringIDs); err != nil {
+			s.log.Warn("skipping invalid backfill id: %v", err)
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		s.enqueue(ctx, id)
+		n++
+	}
+	if err = scanner.Err(); err != nil {
+		s.log.Error(errors.Wrapf(err, "reading backfill source %s after %v ids", s.cfg.BackfillSource, n))
+		return
+	}
+	s.log.Info("backfilled %v ids from %s", n, s.cfg.BackfillSource)
+}
+
+// openBackfillSource opens BackfillSource as a URL when it has an http(s) scheme, as a file path otherwise
+func (s *service) openBackfillSource(ctx context.Context) (io.ReadCloser, error) {
+	if !strings.HasPrefix(s.cfg.BackfillSource, "http://") && !strings.HasPrefix(s.cfg.BackfillSource, "https://") {
+		return os.Open(s.cfg.BackfillSource)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.cfg.BackfillSource, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := (&http.Client{Timeout: time.Minute}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, errors.Errorf("unexpected status %v", resp.StatusCode)
+	}
+	return resp.Body, nil
+}
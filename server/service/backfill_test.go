@@ -0,0 +1,58 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/poodbooq/bitburst_server/models"
+)
+
+func TestBackfillEnqueuesSampleFile(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		requested []models.ID
+	)
+	tester := newTester(t, func(id models.ID) bool {
+		mu.Lock()
+		requested = append(requested, id)
+		mu.Unlock()
+		return true
+	})
+	source := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	t.Cleanup(source.Close)
+
+	for _, path := range []string{"testdata/backfill_ids.txt", source.URL + "/backfill_ids.txt"} {
+		mu.Lock()
+		requested = nil
+		mu.Unlock()
+		cfg := testConfig()
+		useTester(t, &cfg, tester)
+		cfg.SkipColdStart = true
+		cfg.BackfillSource = path
+		db := newFakeDB()
+		s, log := newTestService(t, db, cfg)
+		runService(t, s)
+
+		waitFor(t, "backfilled ids to be stored", func() bool {
+			return db.has("1") && db.has("2") && db.has("3") && db.has("4")
+		})
+		if !log.has("INFO", "backfilled 4 ids from "+path) {
+			t.Errorf("backfill from %s not logged:\n%s", path, strings.Join(log.all(), "\n"))
+		}
+		if !log.has("WARN", "skipping invalid backfill id") {
+			t.Errorf("invalid id in %s not reported", path)
+		}
+		mu.Lock()
+		got := append([]models.ID(nil), requested...)
+		mu.Unlock()
+		sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+		if !reflect.DeepEqual(got, []models.ID{"1", "2", "3", "4"}) {
+			t.Errorf("backfill from %s fetched %v from the tester, want 1..4", path, got)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/poodbooq/bitburst_server/models"
+)
+
+func TestBatchUpsertIsolatesPoisonRow(t *testing.T) {
+	cfg := testConfig()
+	useTester(t, &cfg, newTester(t, func(models.ID) bool { return true }))
+	cfg.SkipColdStart = true
+	cfg.UpsertBatchSize = 5
+	cfg.UpsertFlushMs = 60000 // only a full batch flushes
+	db := newFakeDB()
+	db.setHook(func(ctx context.Context, op string, ids []models.ID) error {
+		for _, id := range ids {
+			if id == "13" && (op == "upsert" || op == "upsert_batch") {
+				return errors.New("invalid input syntax for type timestamp")
+			}
+		}
+		return nil
+	})
+	s, log := newTestService(t, db, cfg)
+	ingester := newFakeIngester()
+	s.SetIngester(ingester)
+	runService(t, s)
+	<-ingester.started
+
+	ingester.send(t, "1", "2", "13", "4", "5")
+	waitFor(t, "good rows of the batch to persist", func() bool {
+		return db.has("1") && db.has("2") && db.has("4") && db.has("5")
+	})
+	if db.has("13") {
+		t.Error("poison row persisted")
+	}
+	waitFor(t, "poison row to be logged", func() bool { return log.has("ERROR", "upserting id 13 out of a failed batch") })
+	if n := log.count("ERROR", "out of a failed batch"); n != 1 {
+		t.Errorf("%v rows logged as failed, want only the poison one:\n%s", n, log.all())
+	}
+	waitFor(t, "poison row to be counted as dropped", func() bool { return counterValue(t, s.metrics.upsertsDropped) == 1 })
+}
+
+func TestDeferredDeletesFlushOnTimeout(t *testing.T) {
+	cfg := testConfig()
+	useTester(t, &cfg, newTester(t, func(models.ID) bool { return false }))
+	cfg.SkipColdStart = true
+	cfg.DeleteBatchSize = 10
+	cfg.DeleteFlushMs = 500
+	seen := time.Now().UTC()
+	db := newFakeDB(
+		models.Object{ID: "1", LastSeenAt: &seen, Online: true},
+		models.Object{ID: "2", LastSeenAt: &seen, Online: true},
+	)
+	s, _ := newTestService(t, db, cfg)
+	clock := newFakeClock(time.Now())
+	s.SetClock(clock)
+	ingester := newFakeIngester()
+	s.SetIngester(ingester)
+	runService(t, s)
+	<-ingester.started
+
+	ingester.send(t, "1", "2") // well below the threshold of 10
+	waitFor(t, "deletes to wait for the flush window", func() bool {
+		return len(s.deleteCh) == 0 && clock.pending() == 1 && counterValue(t, s.metrics.observations.WithLabelValues(statusOffline)) == 2
+	})
+	clock.Advance(499 * time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	if n := db.callCount("delete_batch"); n != 0 {
+		t.Fatal("batch flushed before its window ran out")
+	}
+	clock.Advance(time.Millisecond)
+	waitFor(t, "batch to flush on timeout", func() bool { return !db.has("1") && !db.has("2") })
+	if n := db.callCount("delete_batch"); n != 1 {
+		t.Fatalf("flushed %v batches, want 1", n)
+	}
+}
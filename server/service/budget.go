@@ -0,0 +1,51 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// retryBudget is a token bucket shared by every retry in the pipeline, so retries
+// can't multiply the load on a struggling tester or database. A nil budget is unlimited.
+type retryBudget struct {
+	mu       *sync.Mutex
+	clock    Clock
+	tokens   float64
+	size     float64
+	refill   float64 // tokens per second
+	refilled time.Time
+}
+
+func newRetryBudget(size, refillPerSec int, clock Clock) *retryBudget {
+	if size <= 0 {
+		return nil
+	}
+	return &retryBudget{
+		mu:       new(sync.Mutex),
+		clock:    clock,
+		tokens:   float64(size),
+		size:     float64(size),
+		refill:   float64(refillPerSec),
+		refilled: clock.Now(),
+	}
+}
+
+// take spends a token for one retry, reporting false when the budget is exhausted
+func (b *retryBudget) take() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.clock.Now()
+	b.tokens += now.Sub(b.refilled).Seconds() * b.refill
+	if b.tokens > b.size {
+		b.tokens = b.size
+	}
+	b.refilled = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,319 @@
+package service
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/poodbooq/bitburst_server/models"
+)
+
+// callbackService returns a service whose /callback passes ids to the returned channel
+func callbackService(t *testing.T, cfg Config) (*service, fakeLogger, chan models.ID) {
+	t.Helper()
+	s, log := newTestService(t, newFakeDB(), cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s.registerRoutes(ctx)
+	out := make(chan models.ID, 100)
+	s.setCallbackTarget(ctx, out)
+	return s, log, out
+}
+
+// receive collects n ids passed on by /callback
+func receive(t *testing.T, out <-chan models.ID, n int) []models.ID {
+	t.Helper()
+	ids := make([]models.ID, 0, n)
+	for len(ids) < n {
+		select {
+		case id := <-out:
+			ids = append(ids, id)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %v of %v callback ids", ids, n)
+		}
+	}
+	return ids
+}
+
+func postCallback(s *service, body string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/callback", strings.NewReader(body))
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	return serve(s, req)
+}
+
+func gzipped(t *testing.T, s string) string {
+	t.Helper()
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return body.String()
+}
+
+func TestGzipCallbackBody(t *testing.T) {
+	s, _, out := callbackService(t, testConfig())
+	body := gzipped(t, `{"object_ids":[1,2,3]}`)
+	rec := postCallback(s, body, "Content-Encoding", "gzip")
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("gzipped callback answered %v: %s", rec.Code, rec.Body)
+	}
+	if ids := receive(t, out, 3); ids[0] != "1" || ids[1] != "2" || ids[2] != "3" {
+		t.Fatalf("gzipped callback passed on %v", ids)
+	}
+}
+
+func TestCorruptGzipCallbackBody(t *testing.T) {
+	s, _, out := callbackService(t, testConfig())
+	body := gzipped(t, `{"object_ids":[1,2,3]}`)
+	corrupt := body[:len(body)/2]
+
+	for name, b := range map[string]string{"truncated": corrupt, "not gzip": `{"object_ids":[1]}`} {
+		if rec := postCallback(s, b, "Content-Encoding", "gzip"); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s gzip body answered %v: %s", name, rec.Code, rec.Body)
+		}
+	}
+	if len(out) != 0 {
+		t.Fatalf("corrupt bodies passed on %v ids", len(out))
+	}
+}
+
+func TestCallbackEchoOnlyWithFlag(t *testing.T) {
+	s, _, out := callbackService(t, testConfig())
+	rec := postCallback(s, `{"object_ids":[4,5]}`)
+	if rec.Code != http.StatusAccepted || rec.Body.String() != `{"enqueued":2}`+"\n" {
+		t.Fatalf("callback without echo answered %v: %q", rec.Code, rec.Body)
+	}
+	receive(t, out, 2)
+
+	cfg := testConfig()
+	cfg.CallbackDebugEcho = true
+	s, _, out = callbackService(t, cfg)
+	rec = postCallback(s, `{"object_ids":[4,5]}`)
+	var echo models.CallbackEcho
+	if err := json.Unmarshal(rec.Body.Bytes(), &echo); err != nil || rec.Code != http.StatusAccepted {
+		t.Fatalf("callback with echo answered %v: %s (%v)", rec.Code, rec.Body, err)
+	}
+	if echo.BatchID == "" || len(echo.ObjectIDs) != 2 || echo.ObjectIDs[0] != "4" || echo.ObjectIDs[1] != "5" {
+		t.Fatalf("echoed %+v", echo)
+	}
+	receive(t, out, 2)
+}
+
+func TestMalformedCallbackCapturedOnlyWithFlag(t *testing.T) {
+	malformed := `{"object_ids":[1,2` + strings.Repeat(" ", 2*capturedBodyLimit)
+	s, log, _ := callbackService(t, testConfig())
+	if rec := postCallback(s, malformed); rec.Code != http.StatusBadRequest {
+		t.Fatalf("malformed callback answered %v", rec.Code)
+	}
+	if log.has("WARN", "malformed callback body") {
+		t.Fatal("malformed body logged without CaptureMalformedCallbacks")
+	}
+
+	cfg := testConfig()
+	cfg.CaptureMalformedCallbacks = true
+	s, log, _ = callbackService(t, cfg)
+	if rec := postCallback(s, malformed); rec.Code != http.StatusBadRequest {
+		t.Fatalf("malformed callback answered %v", rec.Code)
+	}
+	lines := strings.Join(log.all(), "\n")
+	if !log.has("WARN", `malformed callback body from 192.0.2.1:1234 (first 1024 bytes): "{\"object_ids\":[1,2`) {
+		t.Fatalf("malformed body not captured:\n%s", lines)
+	}
+	if strings.Contains(lines, strings.Repeat(" ", capturedBodyLimit)) {
+		t.Fatal("captured body not truncated")
+	}
+}
+
+func TestEmptyCallbackBodyLoggedAtDebug(t *testing.T) {
+	s, log, out := callbackService(t, testConfig())
+	if rec := postCallback(s, ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("empty callback answered %v: %s", rec.Code, rec.Body)
+	}
+	if !log.has("DEBUG", "rejecting callback from 192.0.2.1:1234 with an empty body") || log.count("ERROR", "") != 0 {
+		t.Fatalf("empty body not logged at debug only:\n%s", strings.Join(log.all(), "\n"))
+	}
+
+	if rec := postCallback(s, `{"object_ids":[1,`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("malformed callback answered %v", rec.Code)
+	}
+	if log.count("ERROR", "") != 1 {
+		t.Fatalf("malformed body not logged as an error:\n%s", strings.Join(log.all(), "\n"))
+	}
+	if len(out) != 0 {
+		t.Fatalf("rejected bodies passed on %v ids", len(out))
+	}
+}
+
+func TestNDJSONCallback(t *testing.T) {
+	s, _, out := callbackService(t, testConfig())
+	body := "{\"object_ids\":[1,2]}\n3\n\n{\"object_ids\":[4]}\n5\n"
+	rec := postCallback(s, body, "Content-Type", "application/x-ndjson")
+	if rec.Code != http.StatusAccepted || rec.Body.String() != `{"enqueued":5}`+"\n" {
+		t.Fatalf("ndjson callback answered %v: %s", rec.Code, rec.Body)
+	}
+	ids := receive(t, out, 5)
+	for i, want := range []models.ID{"1", "2", "3", "4", "5"} {
+		if ids[i] != want {
+			t.Fatalf("ndjson callback passed on %v", ids)
+		}
+	}
+
+	rec = postCallback(s, "6\n{\"object_ids\":[7\n", "Content-Type", "application/x-ndjson")
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "after 1 ids") {
+		t.Fatalf("truncated ndjson callback answered %v: %s", rec.Code, rec.Body)
+	}
+	if id := receive(t, out, 1)[0]; id != "6" {
+		t.Fatalf("ids before the broken line passed on %v, want 6", id)
+	}
+}
+
+func TestCallbacksRejectedUntilColdStartDone(t *testing.T) {
+	cfg := testConfig()
+	cfg.RejectCallbacksDuringColdStart = true
+	db := newFakeDB()
+	release := make(chan struct{})
+	db.setHook(func(ctx context.Context, op string, ids []models.ID) error {
+		if op == "get_all" {
+			<-release // a cold start reading a huge table
+		}
+		return nil
+	})
+	s, _ := newTestService(t, db, cfg)
+	runService(t, s)
+	waitFor(t, "cold start to begin", func() bool { return db.callCount("get_all") == 1 && s.callbackTargetOut() != nil })
+
+	if rec := postCallback(s, `{"object_ids":[1]}`); rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("callback during cold start answered %v: %s", rec.Code, rec.Body)
+	}
+	if rec := serve(s, httptest.NewRequest(http.MethodGet, "/ready", nil)); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("/ready during cold start answered %v: %s", rec.Code, rec.Body)
+	}
+
+	close(release)
+	waitFor(t, "cold start", s.ColdStartDone)
+	if rec := postCallback(s, `{"object_ids":[1]}`); rec.Code != http.StatusAccepted {
+		t.Fatalf("callback after cold start answered %v: %s", rec.Code, rec.Body)
+	}
+	if rec := serve(s, httptest.NewRequest(http.MethodGet, "/ready", nil)); rec.Code != http.StatusOK {
+		t.Fatalf("/ready after cold start answered %v: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestCallbackUnknownFieldsLenientOrStrict(t *testing.T) {
+	const body = `{"object_ids":[1,2],"source":"tester"}`
+	s, _, out := callbackService(t, testConfig())
+	if rec := postCallback(s, body); rec.Code != http.StatusAccepted {
+		t.Fatalf("callback with an unknown field answered %v in lenient mode: %s", rec.Code, rec.Body)
+	}
+	if ids := receive(t, out, 2); ids[0] != "1" || ids[1] != "2" {
+		t.Fatalf("lenient callback passed on %v", ids)
+	}
+
+	cfg := testConfig()
+	cfg.StrictCallbackFields = true
+	s, _, out = callbackService(t, cfg)
+	for _, tc := range []struct {
+		body, header, want string
+	}{
+		{body, "application/json", `unknown field \"source\"`},
+		{"3\n{\"object_ids\":[4],\"source\":\"tester\"}\n", "application/x-ndjson", `unknown field \"source\" after 1 ids`},
+	} {
+		rec := postCallback(s, tc.body, "Content-Type", tc.header)
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), tc.want) {
+			t.Errorf("%s callback with an unknown field answered %v in strict mode: %s", tc.header, rec.Code, rec.Body)
+		}
+	}
+	if id := receive(t, out, 1)[0]; id != "3" {
+		t.Fatalf("ids before the rejected ndjson line passed on %v, want 3", id)
+	}
+	select {
+	case id := <-out:
+		t.Fatalf("strict mode passed on id %v of a rejected value", id)
+	default:
+	}
+	if rec := postCallback(s, `{"object_ids":[5]}`); rec.Code != http.StatusAccepted {
+		t.Errorf("callback without unknown fields answered %v in strict mode: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestConcurrentCallbacksBounded(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxConcurrentCallbacks = 3
+	s, _ := newTestService(t, newFakeDB(), cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s.registerRoutes(ctx)
+	out := make(chan models.ID) // nothing reads yet, so accepted callbacks keep their slots
+	s.setCallbackTarget(ctx, out)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		statuses = make(map[int]int)
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rec := postCallback(s, fmt.Sprintf(`{"object_ids":[%v]}`, i))
+			mu.Lock()
+			statuses[rec.Code]++
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+	if statuses[http.StatusAccepted] != 3 || statuses[http.StatusServiceUnavailable] != 17 {
+		t.Fatalf("20 concurrent callbacks answered %v, want 3 accepted and 17 rejected", statuses)
+	}
+	if n := len(s.callbackSlots); n != 3 {
+		t.Fatalf("%v callbacks in progress, want the bound of 3", n)
+	}
+
+	receive(t, out, 3)
+	waitFor(t, "slots to free up", func() bool { return len(s.callbackSlots) == 0 })
+	if rec := postCallback(s, `{"object_ids":[20]}`); rec.Code != http.StatusAccepted {
+		t.Fatalf("callback after the others finished answered %v: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestCallbackGoroutineExitsWithBlockedPipeline(t *testing.T) {
+	for _, timeoutSec := range []int{0, 1} {
+		cfg := testConfig()
+		cfg.MaxConcurrentCallbacks = 1 // the slot is held until the callback's goroutine returns
+		cfg.CallbackEnqueueTimeoutSec = timeoutSec
+		s, log := newTestService(t, newFakeDB(), cfg)
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		s.registerRoutes(ctx)
+		s.setCallbackTarget(ctx, make(chan models.ID)) // a pipeline that never takes anything
+
+		if rec := postCallback(s, `{"object_ids":[1,2,3]}`); rec.Code != http.StatusAccepted {
+			t.Fatalf("callback answered %v: %s", rec.Code, rec.Body)
+		}
+		time.Sleep(20 * time.Millisecond)
+		if len(s.callbackSlots) != 1 {
+			t.Fatal("callback goroutine returned although nothing took its ids")
+		}
+		if timeoutSec == 0 {
+			cancel() // shutdown
+		}
+		waitFor(t, "callback goroutine to exit", func() bool { return len(s.callbackSlots) == 0 })
+		if !log.has("WARN", "dropping 3 callback ids, pipeline didn't accept them") {
+			t.Errorf("dropped ids not logged:\n%s", strings.Join(log.all(), "\n"))
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package service
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/poodbooq/bitburst_server/logger"
+	"github.com/poodbooq/bitburst_server/models"
+)
+
+func newHTTPClient(cfg Config, log logger.Logger) (*http.Client, error) {
+	tlsCfg, err := newTesterTLSConfig(cfg.HTTP)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.HTTP.TesterInsecureSkipVerify {
+		log.Warn("TLS certificate verification of the tester is DISABLED, never use this outside of local or staging environments")
+	}
+	tr := &http.Transport{
+		MaxIdleConns:    cfg.MaxObjectsPerRequest,
+		MaxConnsPerHost: cfg.MaxObjectsPerRequest,
+		TLSClientConfig: tlsCfg,
+	}
+	return &http.Client{
+		Timeout:       time.Duration(cfg.HTTP.TimeoutSec) * time.Second,
+		Transport:     tr,
+		CheckRedirect: checkTesterRedirect(cfg.HTTP, log),
+	}, nil
+}
+
+// checkTesterRedirect logs every redirect of a tester request, refusing to follow it when TesterDisableRedirects is set
+func checkTesterRedirect(cfg HttpConfig, log logger.Logger) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if cfg.TesterDisableRedirects {
+			log.Warn("tester redirected %s to %s, not following", via[len(via)-1].URL, req.URL)
+			return errors.Errorf("tester redirect to %s refused", req.URL)
+		}
+		log.Warn("tester redirected %s to %s, following", via[len(via)-1].URL, req.URL)
+		if len(via) >= 10 { // same limit as the default policy
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+}
+
+// newTesterTLSConfig loads the client certificate and CA bundle used for mutual TLS with the tester,
+// returning nil when no TLS option is configured so the transport keeps its defaults
+func newTesterTLSConfig(cfg HttpConfig) (*tls.Config, error) {
+	if cfg.TesterCertFile == "" && cfg.TesterKeyFile == "" && cfg.TesterCAFile == "" && !cfg.TesterInsecureSkipVerify {
+		return nil, nil
+	}
+	tlsCfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: cfg.TesterInsecureSkipVerify,
+	}
+	if cfg.TesterCertFile != "" || cfg.TesterKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TesterCertFile, cfg.TesterKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading tester client certificate")
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	if cfg.TesterCAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.TesterCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading tester CA bundle")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in tester CA bundle %s", cfg.TesterCAFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	return tlsCfg, nil
+}
+
+// testerStatusError is a tester response with a non-2xx status
+type testerStatusError struct {
+	id     models.ID
+	status int
+}
+
+func (e testerStatusError) Error() string {
+	return fmt.Sprintf("tester answered id=%v with status %v", e.id, e.status)
+}
+
+// retryableFetch reports whether a failed tester request may succeed when repeated:
+// network errors and 5xx responses are, 4xx responses and unreadable bodies aren't
+func retryableFetch(err error) bool {
+	switch err := err.(type) {
+	case testerStatusError:
+		return err.status >= http.StatusInternalServerError
+	case *url.Error:
+		return true
+	}
+	return false
+}
+
+// fetchObject requests id from the tester, repeating failed requests FetchMaxRetries times
+// with exponential backoff and jitter as long as the retry budget allows
+func (s *service) fetchObject(ctx context.Context, id models.ID) (models.Object, error) {
+	backoff := time.Duration(s.cfg.HTTP.FetchBackoffBaseMs) * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		info, err := s.requestObject(ctx, id)
+		if err == nil || !retryableFetch(err) || ctx.Err() != nil {
+			return info, err
+		}
+		if attempt >= s.cfg.HTTP.FetchMaxRetries {
+			if attempt > 0 {
+				s.log.Warn("giving up on id=%v after %v attempts: %v", id, attempt+1, err)
+			}
+			return info, err
+		}
+		if !s.retries.take() {
+			s.metrics.retriesSkipped.Inc()
+			s.log.Warn("retry budget exhausted, giving up on id=%v: %v", id, err)
+			return info, err
+		}
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)) // jitter, so ids failing together don't retry in lockstep
+		s.log.Debug("tester request for id=%v failed, retrying in %v: %v", id, wait, err)
+		select {
+		case <-ctx.Done():
+			return models.Object{}, ctx.Err()
+		case <-time.After(wait):
+		}
+		backoff *= 2
+	}
+}
+
+func (s *service) requestObject(ctx context.Context, id models.ID) (_ models.Object, err error) {
+	if s.testerLimiter != nil {
+		if err = s.testerLimiter.Wait(ctx); err != nil {
+			return models.Object{}, errors.Wrapf(err, "waiting for the tester rate limit for id=%v", id)
+		}
+	}
+	req, err := s.newFetchRequest(ctx, id)
+	if err != nil {
+		return models.Object{}, err
+	}
+	req.Header.Set("Accept-Encoding", "gzip") // set explicitly, the transport then leaves decompression to us
+	s.log.Debug("requesting info by id=%v", id)
+	defer func() {
+		if err != nil {
+			s.metrics.testerErrors.Inc()
+		}
+	}()
+	start := s.clock.Now()
+	resp, err := s.httpClient.Do(req)
+	s.metrics.testerLatency.Observe(s.clock.Now().Sub(start).Seconds())
+	if err != nil {
+		return models.Object{}, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+		return models.Object{}, testerStatusError{id: id, status: resp.StatusCode}
+	}
+	var (
+		info models.Object
+		body = io.Reader(resp.Body)
+	)
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			_ = resp.Body.Close()
+			return models.Object{}, errors.Wrapf(err, "decompressing tester response for id=%v", id)
+		}
+		defer zr.Close()
+		body = zr
+	}
+	dec := json.NewDecoder(body)
+	err = dec.Decode(&info)
+	if err == nil && s.cfg.HTTP.StrictTesterResponse {
+		// Decoder.More returns false on a stray ] or }, so require io.EOF from a second Decode to reject trailing data
+		var trailing json.RawMessage
+		if errTrailing := dec.Decode(&trailing); errTrailing != io.EOF {
+			err = errors.Errorf("unexpected data after tester response for id=%v", id)
+		}
+	}
+	if errBodyClose := resp.Body.Close(); errBodyClose != nil {
+		s.log.Error(errBodyClose)
+	}
+	if err != nil {
+		return models.Object{}, err
+	}
+	return info, nil
+}
+
+// newFetchRequest builds the tester request for id according to TesterMethod
+func (s *service) newFetchRequest(ctx context.Context, id models.ID) (*http.Request, error) {
+	base := fmt.Sprintf("%s://%s:%s/objects", s.cfg.HTTP.TesterScheme, s.cfg.HTTP.TesterHost, s.cfg.HTTP.TesterPort)
+	if s.cfg.HTTP.TesterMethod != http.MethodPost {
+		return http.NewRequestWithContext(ctx, http.MethodGet, base+"/"+url.PathEscape(string(id)), nil)
+	}
+	body, err := json.Marshal(models.ObjectRequest{ID: id})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// selfTest requests TesterSelfTestPath until the tester answers with a 2xx status, giving up after
+// TesterSelfTestRetries more attempts. The service only becomes ready once it succeeded.
+func (s *service) selfTest(ctx context.Context) {
+	url := fmt.Sprintf("%s://%s:%s%s", s.cfg.HTTP.TesterScheme, s.cfg.HTTP.TesterHost, s.cfg.HTTP.TesterPort, s.cfg.HTTP.TesterSelfTestPath)
+	for attempt := 0; ; attempt++ {
+		err := s.requestSelfTest(ctx, url)
+		if err == nil {
+			s.log.Info("tester self-test against %s passed", url)
+			atomic.StoreInt32(&s.testerReached, 1)
+			return
+		}
+		if attempt >= s.cfg.HTTP.TesterSelfTestRetries {
+			s.log.Error(errors.Wrapf(err, "tester self-test against %s failed after %v attempts, service stays unready", url, attempt+1))
+			return
+		}
+		s.log.Warn("tester self-test against %s failed, retrying: %v", url, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (s *service) requestSelfTest(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if err = resp.Body.Close(); err != nil {
+		s.log.Error(err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("unexpected status %v", resp.StatusCode)
+	}
+	return nil
+}
+
+// fetchCoalesced shares a single tester request between all callers asking for the same id while it is in flight.
+// The shared request runs detached from whichever caller started it, so that caller giving up doesn't fail the
+// others. Every caller still stops waiting once its own ctx is done.
+func (s *service) fetchCoalesced(ctx context.Context, id models.ID) (models.Object, error) {
+	results := s.fetches.DoChan(string(id), func() (interface{}, error) {
+		fetchCtx, cancel := s.detachedFetchContext()
+		defer cancel()
+		return s.fetchObject(fetchCtx, id)
+	})
+	select {
+	case <-ctx.Done():
+		return models.Object{}, errors.Wrapf(ctx.Err(), "waiting for the tester response for id=%v", id)
+	case res := <-results:
+		if res.Shared {
+			s.log.Debug("shared in-flight tester request for id=%v", id)
+		}
+		if res.Err != nil {
+			return models.Object{}, res.Err
+		}
+		return res.Val.(models.Object), nil
+	}
+}
+
+// detachedFetchContext bounds a shared tester request by the longest its attempts may take:
+// TimeoutSec each, plus the backoff between them. Without a TimeoutSec it is unbounded, like the requests.
+func (s *service) detachedFetchContext() (context.Context, context.CancelFunc) {
+	if s.cfg.HTTP.TimeoutSec <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	attempts := s.cfg.HTTP.FetchMaxRetries + 1
+	budget := time.Duration(attempts) * time.Duration(s.cfg.HTTP.TimeoutSec) * time.Second
+	backoff := time.Duration(s.cfg.HTTP.FetchBackoffBaseMs) * time.Millisecond
+	for i := 1; i < attempts; i++ {
+		budget += backoff
+		backoff *= 2
+	}
+	return context.WithTimeout(context.Background(), budget)
+}
@@ -0,0 +1,293 @@
+package service
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/poodbooq/bitburst_server/models"
+)
+
+func TestCoalescedFetchOutlivesTheCallerThatStartedIt(t *testing.T) {
+	var requests int32
+	release := make(chan struct{})
+	tester := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			<-release
+		}
+		_ = json.NewEncoder(w).Encode(models.Object{ID: "1", Online: true})
+	}))
+	defer tester.Close()
+	cfg := testConfig()
+	useTester(t, &cfg, tester)
+	s, _ := newTestService(t, newFakeDB(), cfg)
+
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := s.fetchCoalesced(firstCtx, "1")
+		first <- err
+	}()
+	waitFor(t, "shared request to reach the tester", func() bool { return atomic.LoadInt32(&requests) == 1 })
+	second := make(chan models.Object, 1)
+	go func() {
+		obj, err := s.fetchCoalesced(context.Background(), "1")
+		if err != nil {
+			t.Error(err)
+		}
+		second <- obj
+	}()
+	time.Sleep(50 * time.Millisecond) // the second caller joins the request in flight
+
+	cancelFirst()
+	select {
+	case err := <-first:
+		if err == nil {
+			t.Fatal("cancelled caller got no error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("cancelled caller kept waiting for the shared request")
+	}
+	close(release)
+	select {
+	case obj := <-second:
+		if obj.ID != "1" || !obj.Online {
+			t.Fatalf("second caller got %+v", obj)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("second caller never got the shared response")
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("tester saw %v requests, want them coalesced into 1", n)
+	}
+}
+
+func TestTrailingTesterData(t *testing.T) {
+	bodies := map[string]bool{ // body -> accepted in strict mode
+		`{"id":1,"online":true}`:                        true,
+		"{\"id\":1,\"online\":true}\n":                  true,
+		`{"id":1,"online":true}{"id":1,"online":false}`: false,
+		`{"id":1,"online":true}]`:                       false,
+		`{"id":1,"online":true} garbage`:                false,
+	}
+	for body, strictOK := range bodies {
+		tester := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte(body))
+		}))
+		for _, strict := range []bool{false, true} {
+			cfg := testConfig()
+			useTester(t, &cfg, tester)
+			cfg.HTTP.StrictTesterResponse = strict
+			s, _ := newTestService(t, newFakeDB(), cfg)
+			obj, err := s.requestObject(context.Background(), "1")
+			if accepted := err == nil; accepted != (strictOK || !strict) {
+				t.Errorf("strict=%v: body %q accepted=%v (%v)", strict, body, accepted, err)
+			}
+			if err == nil && (obj.ID != "1" || !obj.Online) {
+				t.Errorf("strict=%v: body %q decoded as %+v", strict, body, obj)
+			}
+		}
+		tester.Close()
+	}
+}
+
+func TestSelfTestAgainstUnreachableTesterKeepsServiceUnready(t *testing.T) {
+	cfg := testConfig() // points at a port nothing listens on
+	cfg.HTTP.TesterSelfTest = true
+	cfg.HTTP.TesterSelfTestPath = "/objects/1"
+	cfg.HTTP.TesterSelfTestRetries = 1
+	s, log := newTestService(t, newFakeDB(), cfg)
+	runService(t, s)
+
+	waitFor(t, "self-test to give up", func() bool { return log.has("ERROR", "failed after 2 attempts, service stays unready") })
+	waitFor(t, "cold start", s.ColdStartDone)
+	if s.Ready() {
+		t.Fatal("service ready although the tester was never reached")
+	}
+	if rec := serve(s, httptest.NewRequest(http.MethodGet, "/ready", nil)); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("/ready answered %v with an unreachable tester", rec.Code)
+	}
+
+	cfg = testConfig()
+	useTester(t, &cfg, newTester(t, func(models.ID) bool { return true }))
+	cfg.HTTP.TesterSelfTest = true
+	cfg.HTTP.TesterSelfTestPath = "/objects/1"
+	reachable, _ := newTestService(t, newFakeDB(), cfg)
+	runService(t, reachable)
+	waitFor(t, "reachable tester to make the service ready", reachable.Ready)
+}
+
+func TestPostTesterRequestCarriesID(t *testing.T) {
+	type request struct {
+		method, path, contentType, body string
+	}
+	requests := make(chan request, 2)
+	tester := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- request{r.Method, r.URL.Path, r.Header.Get("Content-Type"), string(body)}
+		var in models.ObjectRequest
+		_ = json.Unmarshal(body, &in)
+		_ = json.NewEncoder(w).Encode(models.Object{ID: in.ID, Online: true})
+	}))
+	t.Cleanup(tester.Close)
+	cfg := testConfig()
+	useTester(t, &cfg, tester)
+	cfg.HTTP.TesterMethod = http.MethodPost
+	cfg.StringIDs = true
+	s, _ := newTestService(t, newFakeDB(), cfg)
+
+	for id, want := range map[models.ID]string{"42": `{"id":42}`, "a-1": `{"id":"a-1"}`} {
+		obj, err := s.requestObject(context.Background(), id)
+		if err != nil || obj.ID != id || !obj.Online {
+			t.Fatalf("POST lookup of %v returned %+v, %v", id, obj, err)
+		}
+		got := <-requests
+		if got != (request{http.MethodPost, "/objects", "application/json", want}) {
+			t.Errorf("lookup of %v sent %+v, want POST /objects with body %s", id, got, want)
+		}
+	}
+}
+
+func TestRetriesThrottledOnceBudgetDepleted(t *testing.T) {
+	var requests int32
+	tester := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable) // a tester outage
+	}))
+	t.Cleanup(tester.Close)
+	cfg := testConfig()
+	useTester(t, &cfg, tester)
+	cfg.HTTP.FetchMaxRetries = 10
+	cfg.HTTP.FetchBackoffBaseMs = 1
+	cfg.RetryBudget = 3
+	cfg.RetryBudgetRefillPerSec = 1
+	s, log := newTestService(t, newFakeDB(), cfg)
+	clock := newFakeClock(time.Now())
+	s.SetClock(clock)
+
+	fetch := func(wantRequests int32, wantSkipped float64) {
+		t.Helper()
+		atomic.StoreInt32(&requests, 0)
+		if _, err := s.fetchObject(context.Background(), "1"); err == nil {
+			t.Fatal("fetch succeeded against a failing tester")
+		}
+		if n := atomic.LoadInt32(&requests); n != wantRequests {
+			t.Errorf("tester saw %v requests, want %v", n, wantRequests)
+		}
+		if n := counterValue(t, s.metrics.retriesSkipped); n != wantSkipped {
+			t.Errorf("retries_skipped_total = %v, want %v", n, wantSkipped)
+		}
+	}
+	fetch(4, 1) // the first attempt plus the budget of 3 retries
+	fetch(1, 2) // depleted, no retries at all
+	if n := log.count("WARN", "retry budget exhausted, giving up on id=1"); n != 2 {
+		t.Errorf("%v budget warnings, want 2", n)
+	}
+	clock.Advance(2 * time.Second) // refills 2 tokens
+	fetch(3, 3)
+}
+
+func TestTesterRedirectsNotFollowedWhenDisabled(t *testing.T) {
+	var followed int32
+	tester := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/elsewhere" {
+			atomic.AddInt32(&followed, 1)
+			_ = json.NewEncoder(w).Encode(models.Object{ID: "1", Online: true})
+			return
+		}
+		http.Redirect(w, r, "/elsewhere", http.StatusFound)
+	}))
+	t.Cleanup(tester.Close)
+
+	for _, disabled := range []bool{false, true} {
+		atomic.StoreInt32(&followed, 0)
+		cfg := testConfig()
+		useTester(t, &cfg, tester)
+		cfg.HTTP.TesterDisableRedirects = disabled
+		s, log := newTestService(t, newFakeDB(), cfg)
+		obj, err := s.requestObject(context.Background(), "1")
+		n := atomic.LoadInt32(&followed)
+		if disabled {
+			if err == nil || n != 0 {
+				t.Errorf("redirect followed with redirects disabled: %+v, %v, %v requests to the target", obj, err, n)
+			}
+			if !log.has("WARN", "/objects/1 to "+tester.URL+"/elsewhere, not following") {
+				t.Errorf("refused redirect not logged:\n%s", strings.Join(log.all(), "\n"))
+			}
+			continue
+		}
+		if err != nil || !obj.Online || n != 1 {
+			t.Errorf("redirect not followed by default: %+v, %v, %v requests to the target", obj, err, n)
+		}
+		if !log.has("WARN", "/elsewhere, following") {
+			t.Errorf("followed redirect not logged:\n%s", strings.Join(log.all(), "\n"))
+		}
+	}
+}
+
+func TestGzipTesterResponseDecoded(t *testing.T) {
+	tester := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			_ = json.NewEncoder(w).Encode(models.Object{ID: "1"}) // offline, so a missing header fails the test
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		_ = json.NewEncoder(zw).Encode(models.Object{ID: "1", Online: true})
+		_ = zw.Close()
+	}))
+	t.Cleanup(tester.Close)
+	cfg := testConfig()
+	useTester(t, &cfg, tester)
+	s, _ := newTestService(t, newFakeDB(), cfg)
+
+	obj, err := s.requestObject(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.ID != "1" || !obj.Online {
+		t.Fatalf("gzipped tester response decoded as %+v", obj)
+	}
+}
+
+func TestTesterRequestsLimitedToRPS(t *testing.T) {
+	var requests int32
+	tester := newTester(t, func(models.ID) bool {
+		atomic.AddInt32(&requests, 1)
+		return true
+	})
+	cfg := testConfig()
+	useTester(t, &cfg, tester)
+	cfg.HTTP.TesterRPS = 20
+	cfg.HTTP.TesterBurst = 2
+	s, _ := newTestService(t, newFakeDB(), cfg)
+
+	const n = 12
+	start := time.Now()
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			_, err := s.requestObject(context.Background(), "1")
+			errs <- err
+		}()
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the burst starts at once, the other 10 are spaced 50ms apart
+	if elapsed, want := time.Since(start), 450*time.Millisecond; elapsed < want {
+		t.Errorf("%v requests at 20 RPS with a burst of 2 took %v, want at least %v", n, elapsed, want)
+	}
+	if got := atomic.LoadInt32(&requests); got != n {
+		t.Errorf("tester saw %v requests, want %v", got, n)
+	}
+}
@@ -0,0 +1,48 @@
+package service
+
+import "time"
+
+// Clock is the time source of the pipeline, replaceable through SetClock to drive timers deterministically
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// SetClock replaces the wall clock behind timers, deadlines, flush windows and latencies,
+// so tests can drive them deterministically. Timers armed before the call keep the old clock.
+func (s *service) SetClock(clock Clock) {
+	if s == nil || clock == nil {
+		return
+	}
+	s.clock = clock
+	s.retries = newRetryBudget(s.cfg.RetryBudget, s.cfg.RetryBudgetRefillPerSec, clock)
+}
+
+// after is time.After on the service clock
+func (s *service) after(d time.Duration) <-chan time.Time {
+	return s.clock.NewTimer(d).C()
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
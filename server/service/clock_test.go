@@ -0,0 +1,286 @@
+package service
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/poodbooq/bitburst_server/models"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// fakeClock only moves when advanced, firing the timers whose deadline it passes
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock    *fakeClock
+	c        chan time.Time
+	deadline time.Time
+	active   bool
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1)}
+	c.timers = append(c.timers, t)
+	t.resetLocked(d)
+	return t
+}
+
+// Advance moves the clock forward by d, firing every timer due by then
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.timers {
+		t.fireIfDueLocked()
+	}
+}
+
+// pending returns how many timers are armed and haven't fired yet
+func (c *fakeClock) pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, t := range c.timers {
+		if t.active {
+			n++
+		}
+	}
+	return n
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	wasActive := t.active
+	t.active = false
+	return wasActive
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	wasActive := t.active
+	t.resetLocked(d)
+	return wasActive
+}
+
+func (t *fakeTimer) resetLocked(d time.Duration) {
+	t.deadline = t.clock.now.Add(d)
+	t.active = true
+	t.fireIfDueLocked()
+}
+
+func (t *fakeTimer) fireIfDueLocked() {
+	if !t.active || t.clock.now.Before(t.deadline) {
+		return
+	}
+	t.active = false
+	select {
+	case t.c <- t.clock.now:
+	default:
+	}
+}
+
+// timerCount returns how many ids have an expiration timer armed
+func (s *service) timerCount() int {
+	s.timers.mu.Lock()
+	defer s.timers.mu.Unlock()
+	return len(s.timers.byID)
+}
+
+// startWithFakeClock runs a service whose ids come from a fake ingester and which looks them up
+// at a tester reporting every id online
+func startWithFakeClock(t *testing.T, cfg Config) (*service, *fakeDB, *fakeClock, *fakeIngester) {
+	t.Helper()
+	useTester(t, &cfg, newTester(t, func(models.ID) bool { return true }))
+	cfg.SkipColdStart = true
+	db := newFakeDB()
+	s, _ := newTestService(t, db, cfg)
+	clock := newFakeClock(time.Now())
+	s.SetClock(clock)
+	ingester := newFakeIngester()
+	s.SetIngester(ingester)
+	runService(t, s)
+	<-ingester.started
+	return s, db, clock, ingester
+}
+
+func TestFakeClockDrivesExpiration(t *testing.T) {
+	s, db, clock, ingester := startWithFakeClock(t, testConfig())
+	ingester.send(t, "1")
+	waitFor(t, "object stored with a timer", func() bool { return db.has("1") && s.timerCount() == 1 })
+
+	clock.Advance(59 * time.Second)
+	time.Sleep(20 * time.Millisecond)
+	if !db.has("1") || s.timerCount() != 1 {
+		t.Fatal("object expired before its retention ran out")
+	}
+	clock.Advance(time.Second)
+	waitFor(t, "expired object to be deleted", func() bool { return !db.has("1") && s.timerCount() == 0 })
+}
+
+func TestFakeClockRefreshPostponesExpiration(t *testing.T) {
+	s, db, clock, ingester := startWithFakeClock(t, testConfig())
+	ingester.send(t, "1")
+	waitFor(t, "object stored with a timer", func() bool { return s.timerCount() == 1 })
+
+	clock.Advance(30 * time.Second)
+	ingester.send(t, "1")
+	waitFor(t, "refresh", func() bool { obj, _ := db.get("1"); return obj.SeenCount == 2 })
+	waitFor(t, "timer refresh", func() bool { return counterValue(t, s.metrics.timersRefreshed) == 1 })
+
+	clock.Advance(45 * time.Second) // 75s after the first sighting, 45s after the second
+	time.Sleep(20 * time.Millisecond)
+	if !db.has("1") {
+		t.Fatal("refreshed object expired counting from its first sighting")
+	}
+	clock.Advance(15 * time.Second)
+	waitFor(t, "refreshed object to expire", func() bool { return !db.has("1") })
+}
+
+func TestObservationAfterTimerFiredSupersedesExpiryDelete(t *testing.T) {
+	s, db, clock, ingester := startWithFakeClock(t, testConfig())
+	log := s.log.(fakeLogger)
+	ingester.send(t, "1")
+	waitFor(t, "object stored with a timer", func() bool { return db.has("1") && s.timerCount() == 1 })
+
+	unlock := s.locks.lock("1") // holds the expiry delete back until the object is seen again
+	clock.Advance(61 * time.Second)
+	waitFor(t, "timer to fire", func() bool { return s.timerCount() == 0 })
+	ingester.send(t, "1")
+	waitFor(t, "new sighting to arm a timer", func() bool { return s.timerCount() == 1 })
+	unlock()
+
+	waitFor(t, "expiry delete to be skipped", func() bool { return log.has("DEBUG", "skipping delete of id=1, superseded") })
+	waitFor(t, "new sighting to be stored", func() bool { obj, _ := db.get("1"); return obj.SeenCount == 2 })
+	if n := db.callCount("delete"); n != 0 {
+		t.Fatalf("expiry delete applied after the object was seen again (%v deletes)", n)
+	}
+	if observed, timed := s.tracked("1"); !observed || !timed {
+		t.Fatal("object seen again lost its observation or timer")
+	}
+}
+
+func TestFakeClockStampsLatencies(t *testing.T) {
+	s, _ := newTestService(t, newFakeDB(), testConfig())
+	start := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := newFakeClock(start)
+	s.SetClock(clock)
+
+	go s.enqueue(context.Background(), "5")
+	queued := <-s.inputCh
+	if !queued.acceptedAt.Equal(start) {
+		t.Fatalf("enqueue stamped %v, want the fake clock's %v", queued.acceptedAt, start)
+	}
+	clock.Advance(3 * time.Second)
+	s.observeLatency(queued)
+	count, sum := histogramValue(t, s.metrics.callbackToPersist)
+	if count != 1 || sum != 3 {
+		t.Fatalf("latency histogram has %v samples summing to %v, want 1 of 3s", count, sum)
+	}
+}
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func histogramValue(t *testing.T, h prometheus.Histogram) (uint64, float64) {
+	t.Helper()
+	var m dto.Metric
+	if err := h.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+// Run with -race: timers fire, refresh and get removed concurrently while the delete consumer is stuck
+func TestTimersRaceWithStuckDeleteConsumer(t *testing.T) {
+	cfg := testConfig()
+	cfg.DBMaxConcurrentWrites = 1 // one stuck delete stops the consumer draining deleteCh
+	s, db, clock, ingester := startWithFakeClock(t, cfg)
+	release := make(chan struct{})
+	var once sync.Once
+	unblock := func() { once.Do(func() { close(release) }) }
+	t.Cleanup(unblock)
+	db.setHook(func(ctx context.Context, op string, ids []models.ID) error {
+		if op == "delete" {
+			<-release
+		}
+		return nil
+	})
+
+	const ids = 20
+	for i := 1; i <= ids; i++ {
+		ingester.send(t, models.ID(strconv.Itoa(i)))
+	}
+	waitFor(t, "every timer armed", func() bool { return s.timerCount() == ids })
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { // refreshes racing the timers firing below
+		defer wg.Done()
+		for round := 0; round < 3; round++ {
+			for i := 1; i <= ids; i += 2 {
+				ingester.ids <- models.ID(strconv.Itoa(i))
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 3; i++ {
+			clock.Advance(s.retention())
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	wg.Wait()
+	waitFor(t, "expired deletes to back up", func() bool { return len(s.deleteCh) == cap(s.deleteCh) })
+
+	// the delete consumer is stuck, so expired timers wait to hand over their deletes; they mustn't hold the timers lock meanwhile
+	inspected := make(chan struct{})
+	go func() {
+		s.timerCount()
+		s.timers.dump(clock.Now())
+		close(inspected)
+	}()
+	select {
+	case <-inspected:
+	case <-time.After(time.Second):
+		t.Fatal("timers lock held while waiting on the stuck delete consumer")
+	}
+
+	unblock()
+	waitFor(t, "every object to expire", func() bool {
+		clock.Advance(s.retention()) // refreshes still in the pipeline may arm timers after any single advance
+		n, _ := db.Count(context.Background())
+		return n == 0 && s.timerCount() == 0
+	})
+}
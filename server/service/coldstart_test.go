@@ -0,0 +1,259 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/poodbooq/bitburst_server/models"
+)
+
+func TestColdStartPagesCoverObjectsDeletedUnderThem(t *testing.T) {
+	now := time.Now().UTC()
+	var objs []models.Object
+	for i := 1; i <= 40; i++ {
+		seen := now.Add(-time.Second)
+		// the first half is offline, so cold start deletes it while later pages are still unread
+		objs = append(objs, models.Object{ID: models.ID(strconv.Itoa(i)), LastSeenAt: &seen, Online: i > 20})
+	}
+	db := newFakeDB(objs...)
+	var (
+		mu                sync.Mutex
+		inFlight, maxSeen int
+	)
+	db.setHook(func(ctx context.Context, op string, ids []models.ID) error {
+		if op != "get_range" {
+			return nil
+		}
+		mu.Lock()
+		inFlight++
+		if inFlight > maxSeen {
+			maxSeen = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return nil
+	})
+	cfg := testConfig()
+	cfg.ColdStartPageSize = 5
+	cfg.ColdStartMaxQueries = 2
+	cfg.ColdStartWorkers = 4
+	s, _ := newTestService(t, db, cfg)
+	runService(t, s)
+
+	waitFor(t, "cold start", s.ColdStartDone)
+	waitFor(t, "offline objects to be deleted", func() bool {
+		for i := 1; i <= 20; i++ {
+			if db.has(models.ID(strconv.Itoa(i))) {
+				return false
+			}
+		}
+		return true
+	})
+	waitFor(t, "every online object to get a timer", func() bool { return s.timerCount() == 20 })
+	if n := db.callCount("get_range"); n != 8 {
+		t.Errorf("read %v pages of 5 out of 40 objects, want 8", n)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if maxSeen > cfg.ColdStartMaxQueries {
+		t.Errorf("%v page queries in flight at once, want at most %v", maxSeen, cfg.ColdStartMaxQueries)
+	}
+}
+
+// BenchmarkColdStart feeds a large table mixing expired and live objects through consumers that each
+// take a while per object, as the delete writers and the expiration loop do. A single feeder stalls
+// on whichever channel is full while the other consumer idles, several keep both busy.
+func BenchmarkColdStart(b *testing.B) {
+	const objects = 2000
+	var (
+		now            = time.Now().UTC()
+		objs           []models.Object
+		expired, alive int
+		rnd            = rand.New(rand.NewSource(1))
+	)
+	for i := 0; i < objects; i++ {
+		seen := now.Add(-time.Second)
+		if rnd.Intn(2) == 0 {
+			seen = now.Add(-time.Hour) // cold start deletes it
+			expired++
+		} else {
+			alive++
+		}
+		objs = append(objs, models.Object{ID: models.ID(strconv.Itoa(i)), LastSeenAt: &seen, Online: true})
+	}
+	for _, workers := range []int{1, 4} {
+		b.Run("workers="+strconv.Itoa(workers), func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				b.StopTimer()
+				cfg := testConfig()
+				cfg.ChannelBufferSize = 1
+				cfg.ColdStartWorkers = workers
+				s, err := newService(newFakeDB(objs...), newFakeLogger(), cfg)
+				if err != nil {
+					b.Fatal(err)
+				}
+				var consumers sync.WaitGroup
+				consumers.Add(2)
+				go func() {
+					defer consumers.Done()
+					for i := 0; i < alive; i++ {
+						<-s.expirationCh
+						time.Sleep(time.Duration(i%4) * 500 * time.Microsecond) // uneven, like the loop contending for the timers lock
+					}
+				}()
+				go func() {
+					defer consumers.Done()
+					for i := 0; i < expired; i++ {
+						<-s.deleteCh
+						time.Sleep(time.Duration(i%4) * 500 * time.Microsecond) // uneven, like writes waiting on the database
+					}
+				}()
+				b.StartTimer()
+				s.reconcileStored(context.Background())
+				consumers.Wait()
+			}
+		})
+	}
+}
+
+func TestBatchedColdStartProcessesEveryObject(t *testing.T) {
+	seen := time.Now().UTC().Add(-time.Second)
+	var objs []models.Object
+	for i := 1; i <= 25; i++ {
+		objs = append(objs, models.Object{ID: models.ID(strconv.Itoa(i)), LastSeenAt: &seen, Online: true})
+	}
+	cfg := testConfig()
+	cfg.ColdStartBatchSize = 4 // 25 objects don't fill the last batch
+	cfg.ColdStartWorkers = 2
+	s, _ := newTestService(t, newFakeDB(objs...), cfg)
+	runService(t, s)
+
+	waitFor(t, "cold start", s.ColdStartDone)
+	waitFor(t, "every object to get a timer", func() bool { return s.timerCount() == 25 })
+}
+
+func TestFutureLastSeenTreatedAsNow(t *testing.T) {
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	future := now.Add(24 * time.Hour) // clock skew on whoever wrote the row
+	s, log := newTestService(t, newFakeDB(models.Object{ID: "1", LastSeenAt: &future, Online: true}), testConfig())
+	clock := newFakeClock(now)
+	s.SetClock(clock)
+	runService(t, s)
+
+	waitFor(t, "timer of the cold started object", func() bool { return s.timerCount() == 1 })
+	s.timers.mu.Lock()
+	deadline := s.timers.byID["1"].deadline
+	s.timers.mu.Unlock()
+	if want := now.Add(s.retention()); !deadline.Equal(want) {
+		t.Fatalf("object seen in the future expires at %v, want %v", deadline, want)
+	}
+	if !log.has("WARN", "in the future, treating it as seen now") {
+		t.Fatalf("future last_seen_at not warned about:\n%s", log.all())
+	}
+}
+
+func TestOfflineObjectsAtColdStartGetNoTimer(t *testing.T) {
+	seen := time.Now().UTC().Add(-time.Second)
+	db := newFakeDB(
+		models.Object{ID: "1", LastSeenAt: &seen, Online: true},
+		models.Object{ID: "2", LastSeenAt: &seen, Online: false}, // recent, but known offline
+	)
+	s, _ := newTestService(t, db, testConfig())
+	runService(t, s)
+
+	waitFor(t, "offline object to be deleted", func() bool { return !db.has("2") })
+	waitFor(t, "cold start", s.ColdStartDone)
+	if _, timed := s.tracked("2"); timed {
+		t.Fatal("offline object got an expiration timer")
+	}
+	waitFor(t, "online object's timer", func() bool { _, timed := s.tracked("1"); return timed })
+}
+
+func TestColdStartSkippedWhenDisabled(t *testing.T) {
+	expired := time.Now().UTC().Add(-time.Hour)
+	fresh := time.Now().UTC()
+	db := newFakeDB(
+		models.Object{ID: "1", LastSeenAt: &expired, Online: true},
+		models.Object{ID: "2", LastSeenAt: &fresh, Online: true},
+	)
+	cfg := testConfig()
+	cfg.SkipColdStart = true
+	s, log := newTestService(t, db, cfg)
+	runService(t, s)
+
+	if !s.ColdStartDone() {
+		t.Fatal("cold start not reported done with SKIP_COLD_START")
+	}
+	time.Sleep(50 * time.Millisecond) // a cold start would have read the table by now
+	if n := db.callCount("get_all") + db.callCount("get_range") + db.callCount("get_page_bounds"); n != 0 {
+		t.Fatalf("stored objects read %v times with cold start disabled", n)
+	}
+	if n := s.timerCount(); n != 0 {
+		t.Errorf("%v timers armed from the database", n)
+	}
+	if !db.has("1") || !db.has("2") {
+		t.Error("stored objects deleted with cold start disabled")
+	}
+	if !log.has("INFO", "cold start disabled") {
+		t.Errorf("disabled cold start not logged:\n%s", strings.Join(log.all(), "\n"))
+	}
+}
+
+func TestColdStartRetriesFailedGetAll(t *testing.T) {
+	seen := time.Now().UTC()
+	db := newFakeDB(models.Object{ID: "1", LastSeenAt: &seen, Online: true})
+	var failures int32 = 2
+	db.setHook(func(ctx context.Context, op string, ids []models.ID) error {
+		if op == "get_all" && atomic.AddInt32(&failures, -1) >= 0 {
+			return errors.New("connection reset by peer")
+		}
+		return nil
+	})
+	cfg := testConfig()
+	cfg.ColdStartRetries = 3
+	cfg.ColdStartBackoffMs = 1
+	s, log := newTestService(t, db, cfg)
+	runService(t, s)
+
+	waitFor(t, "cold start to arm the stored object's timer", func() bool { return s.ColdStartDone() && s.timerCount() == 1 })
+	if n := db.callCount("get_all"); n != 3 {
+		t.Errorf("GetAll called %v times, want 2 failures and a success", n)
+	}
+	if n := log.count("WARN", "reading stored objects failed, retrying"); n != 2 {
+		t.Errorf("%v retries logged, want 2:\n%s", n, strings.Join(log.all(), "\n"))
+	}
+}
+
+func TestColdStartGivesUpAfterRetries(t *testing.T) {
+	seen := time.Now().UTC()
+	db := newFakeDB(models.Object{ID: "1", LastSeenAt: &seen, Online: true})
+	db.setHook(func(ctx context.Context, op string, ids []models.ID) error {
+		if op == "get_all" {
+			return errors.New("connection reset by peer")
+		}
+		return nil
+	})
+	cfg := testConfig()
+	cfg.ColdStartRetries = 1
+	cfg.ColdStartBackoffMs = 1
+	s, _ := newTestService(t, db, cfg)
+	runService(t, s)
+
+	waitFor(t, "cold start to give up", s.ColdStartDone)
+	if n := db.callCount("get_all"); n != 2 {
+		t.Errorf("GetAll called %v times, want the first attempt and 1 retry", n)
+	}
+	if s.timerCount() != 0 {
+		t.Error("timers armed although every read failed")
+	}
+}
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/poodbooq/bitburst_server/postgres"
+)
+
+const (
+	dbErrorDeadline      = "deadline"
+	dbErrorPoolExhausted = "pool_exhausted"
+	dbErrorOther         = "other"
+)
+
+// dbCall runs a database write with its own DBTimeoutMs deadline per attempt. Attempts that only
+// ran out of that deadline, while ctx is still alive, are retried up to DBDeadlineRetries times.
+func (s *service) dbCall(ctx context.Context, op string, call func(ctx context.Context) error) error {
+	for attempt := 0; ; attempt++ {
+		callCtx, cancel := ctx, context.CancelFunc(func() {})
+		if s.cfg.DBTimeoutMs > 0 {
+			callCtx, cancel = context.WithTimeout(ctx, time.Duration(s.cfg.DBTimeoutMs)*time.Millisecond)
+		}
+		err := call(callCtx)
+		deadline := err != nil && (errors.Cause(err) == context.DeadlineExceeded || callCtx.Err() == context.DeadlineExceeded)
+		cancel()
+		if err == nil || err == postgres.ErrObjectNotFound {
+			return err
+		}
+		if err == postgres.ErrPoolExhausted {
+			s.metrics.dbErrors.WithLabelValues(op, dbErrorPoolExhausted).Inc()
+			return errors.Wrap(err, op)
+		}
+		if !deadline {
+			s.metrics.dbErrors.WithLabelValues(op, dbErrorOther).Inc()
+			return err
+		}
+		s.metrics.dbErrors.WithLabelValues(op, dbErrorDeadline).Inc()
+		if ctx.Err() != nil || attempt >= s.cfg.DBDeadlineRetries {
+			return errors.Wrapf(err, "%s exceeded its deadline after %v attempt(s)", op, attempt+1)
+		}
+		if !s.retries.take() {
+			s.metrics.retriesSkipped.Inc()
+			return errors.Wrapf(err, "%s exceeded its deadline and the retry budget is exhausted", op)
+		}
+		s.log.Warn("%s exceeded its deadline, retrying (attempt %v of %v)", op, attempt+2, s.cfg.DBDeadlineRetries+1)
+	}
+}
+
+// acquireDBSlot blocks until fewer than DBMaxConcurrentWrites writes are in flight, so the
+// upsert and delete loops stop draining their channels while the database is saturated and
+// the pipeline backs up to the callers instead of piling up goroutines waiting for connections.
+// It reports false when ctx is done first.
+func (s *service) acquireDBSlot(ctx context.Context) (func(), bool) {
+	if s.dbSlots == nil {
+		return func() {}, true
+	}
+	select {
+	case <-ctx.Done():
+		return nil, false
+	case s.dbSlots <- struct{}{}:
+		return func() { <-s.dbSlots }, true
+	}
+}
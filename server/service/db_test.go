@@ -0,0 +1,112 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/poodbooq/bitburst_server/models"
+	"github.com/poodbooq/bitburst_server/postgres"
+)
+
+func TestDBDeadlineIsCategorizedAndRetried(t *testing.T) {
+	cfg := testConfig()
+	cfg.DBTimeoutMs = 10
+	cfg.DBDeadlineRetries = 2
+	s, log := newTestService(t, newFakeDB(), cfg)
+
+	attempts := 0
+	err := s.dbCall(context.Background(), "upsert", func(ctx context.Context) error {
+		attempts++
+		<-ctx.Done() // a write that never finishes within DBTimeoutMs
+		return ctx.Err()
+	})
+	if errors.Cause(err) != context.DeadlineExceeded {
+		t.Fatalf("dbCall returned %v, want a wrapped deadline error", err)
+	}
+	if attempts != 3 {
+		t.Errorf("%v attempts, want 1 plus %v retries", attempts, cfg.DBDeadlineRetries)
+	}
+	if got := counterValue(t, s.metrics.dbErrors.WithLabelValues("upsert", dbErrorDeadline)); got != 3 {
+		t.Errorf("db_errors_total{kind=deadline} = %v, want 3", got)
+	}
+	if got := counterValue(t, s.metrics.dbErrors.WithLabelValues("upsert", dbErrorOther)); got != 0 {
+		t.Errorf("deadline errors counted as other: %v", got)
+	}
+	if n := log.count("WARN", "upsert exceeded its deadline, retrying"); n != 2 {
+		t.Errorf("%v retry warnings, want 2:\n%s", n, strings.Join(log.all(), "\n"))
+	}
+
+	// a deadline that clears on retry succeeds without surfacing an error
+	attempts = 0
+	err = s.dbCall(context.Background(), "delete", func(ctx context.Context) error {
+		if attempts++; attempts == 1 {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	})
+	if err != nil || attempts != 2 {
+		t.Errorf("dbCall returned %v after %v attempts, want success on the second", err, attempts)
+	}
+}
+
+func TestDBDeadlineNotRetriedWithoutConfig(t *testing.T) {
+	cfg := testConfig()
+	cfg.DBTimeoutMs = 10
+	s, _ := newTestService(t, newFakeDB(), cfg)
+
+	attempts := 0
+	err := s.dbCall(context.Background(), "upsert", func(ctx context.Context) error {
+		attempts++
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err == nil || attempts != 1 {
+		t.Fatalf("dbCall returned %v after %v attempts, want one failed attempt", err, attempts)
+	}
+
+	attempts = 0
+	s.cfg.DBDeadlineRetries = 3
+	failure := errors.New("connection reset")
+	if err := s.dbCall(context.Background(), "upsert", func(ctx context.Context) error {
+		attempts++
+		return failure
+	}); err != failure || attempts != 1 {
+		t.Errorf("dbCall returned %v after %v attempts, other errors are never retried", err, attempts)
+	}
+	if got := counterValue(t, s.metrics.dbErrors.WithLabelValues("upsert", dbErrorOther)); got != 1 {
+		t.Errorf("db_errors_total{kind=other} = %v, want 1", got)
+	}
+	if got := counterValue(t, s.metrics.dbErrors.WithLabelValues("upsert", dbErrorDeadline)); got != 1 {
+		t.Errorf("db_errors_total{kind=deadline} = %v, want 1", got)
+	}
+}
+
+func TestPoolExhaustionReportedAsItsOwnKind(t *testing.T) {
+	cfg := testConfig()
+	useTester(t, &cfg, newTester(t, func(models.ID) bool { return true }))
+	cfg.SkipColdStart = true
+	db := newFakeDB()
+	db.setHook(func(ctx context.Context, op string, ids []models.ID) error {
+		if op == "upsert" {
+			return postgres.ErrPoolExhausted
+		}
+		return nil
+	})
+	s, log := newTestService(t, db, cfg)
+	ingester := newFakeIngester()
+	s.SetIngester(ingester)
+	runService(t, s)
+	<-ingester.started
+
+	ingester.send(t, "1", "2")
+	waitFor(t, "both upserts to fail", func() bool {
+		return counterValue(t, s.metrics.dbErrors.WithLabelValues("upsert", dbErrorPoolExhausted)) == 2
+	})
+	if got := counterValue(t, s.metrics.dbErrors.WithLabelValues("upsert", dbErrorOther)); got != 0 {
+		t.Errorf("pool exhaustion counted as other errors: %v", got)
+	}
+	waitFor(t, "exhaustion logged", func() bool { return log.count("ERROR", "upsert: "+postgres.ErrPoolExhausted.Error()) == 2 })
+}
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/poodbooq/bitburst_server/events"
+	"github.com/poodbooq/bitburst_server/models"
+)
+
+type fakePublisher struct {
+	mu     sync.Mutex
+	events []events.Event
+}
+
+func (p *fakePublisher) Publish(_ context.Context, event events.Event) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.events = append(p.events, event)
+	return nil
+}
+
+func (p *fakePublisher) kinds() []events.Kind {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	kinds := make([]events.Kind, 0, len(p.events))
+	for _, e := range p.events {
+		kinds = append(kinds, e.Kind)
+	}
+	return kinds
+}
+
+func TestStateChangesArePublished(t *testing.T) {
+	var online int32 = 1
+	cfg := testConfig()
+	useTester(t, &cfg, newTester(t, func(models.ID) bool { return atomic.LoadInt32(&online) == 1 }))
+	cfg.SkipColdStart = true
+	db := newFakeDB()
+	s, log := newTestService(t, db, cfg)
+	publisher := new(fakePublisher)
+	s.SetPublisher(publisher)
+	ingester := newFakeIngester()
+	s.SetIngester(ingester)
+	runService(t, s)
+	<-ingester.started
+
+	ingester.send(t, "1")
+	waitFor(t, "object to be seen", func() bool { return len(publisher.kinds()) == 1 })
+	ingester.send(t, "1") // still online, nothing changed
+	waitFor(t, "second observation", func() bool { return log.count("DEBUG", "online=true") == 2 })
+	atomic.StoreInt32(&online, 0)
+	ingester.send(t, "1")
+	waitFor(t, "object to go offline", func() bool { return len(publisher.kinds()) == 2 })
+
+	kinds := publisher.kinds()
+	if kinds[0] != events.KindSeen || kinds[1] != events.KindOffline {
+		t.Fatalf("published %v, want [%s %s]", kinds, events.KindSeen, events.KindOffline)
+	}
+}
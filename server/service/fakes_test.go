@@ -0,0 +1,535 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/pkg/errors"
+	"github.com/poodbooq/bitburst_server/logger"
+	"github.com/poodbooq/bitburst_server/models"
+	"github.com/poodbooq/bitburst_server/postgres"
+)
+
+// fakeDB is an in-memory postgres.Postgres. hook, when set, runs before every operation
+// with its name and the ids it touches, failing the operation when it returns an error.
+type fakeDB struct {
+	mu       sync.Mutex
+	objects  map[models.ID]models.Object
+	events   []string // "<id>:<kind>" of every recorded observation
+	claimed  map[models.ID]time.Time
+	calls    map[string]int
+	hook     func(ctx context.Context, op string, ids []models.ID) error
+	notify   chan models.ID // ids sent through ListenDeletes
+	now      func() time.Time
+	listened int32
+}
+
+var _ postgres.Postgres = (*fakeDB)(nil)
+
+func newFakeDB(objs ...models.Object) *fakeDB {
+	db := &fakeDB{
+		objects: make(map[models.ID]models.Object),
+		claimed: make(map[models.ID]time.Time),
+		calls:   make(map[string]int),
+		notify:  make(chan models.ID),
+		now:     time.Now,
+	}
+	db.put(objs...)
+	return db
+}
+
+func (f *fakeDB) setHook(hook func(ctx context.Context, op string, ids []models.ID) error) {
+	f.mu.Lock()
+	f.hook = hook
+	f.mu.Unlock()
+}
+
+func (f *fakeDB) begin(ctx context.Context, op string, ids ...models.ID) error {
+	f.mu.Lock()
+	f.calls[op]++
+	hook := f.hook
+	f.mu.Unlock()
+	if hook != nil {
+		if err := hook(ctx, op, ids); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+func (f *fakeDB) put(objs ...models.Object) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, obj := range objs {
+		f.objects[obj.ID] = obj
+	}
+}
+
+func (f *fakeDB) get(id models.ID) (models.Object, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.objects[id]
+	return obj, ok
+}
+
+func (f *fakeDB) has(id models.ID) bool {
+	_, ok := f.get(id)
+	return ok
+}
+
+func (f *fakeDB) callCount(op string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[op]
+}
+
+// upsertLocked mirrors upsertObjectQuery
+func (f *fakeDB) upsertLocked(obj models.Object) {
+	stored, ok := f.objects[obj.ID]
+	if !ok {
+		created := f.now().UTC()
+		obj.CreatedAt = &created
+		obj.SeenCount = 1
+		f.objects[obj.ID] = obj
+		return
+	}
+	if stored.LastSeenAt == nil || (obj.LastSeenAt != nil && obj.LastSeenAt.After(*stored.LastSeenAt)) {
+		stored.LastSeenAt = obj.LastSeenAt
+	}
+	stored.SeenCount++
+	stored.Online = obj.Online
+	if obj.Label != nil {
+		stored.Label = obj.Label
+	}
+	f.objects[obj.ID] = stored
+}
+
+func (f *fakeDB) UpsertObject(ctx context.Context, obj models.Object) error {
+	if err := f.begin(ctx, "upsert", obj.ID); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.upsertLocked(obj)
+	return nil
+}
+
+func (f *fakeDB) UpsertObjects(ctx context.Context, objs []models.Object) error {
+	ids := make([]models.ID, len(objs))
+	for i := range objs {
+		ids[i] = objs[i].ID
+	}
+	if err := f.begin(ctx, "upsert_batch", ids...); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, obj := range objs {
+		f.upsertLocked(obj)
+	}
+	return nil
+}
+
+func (f *fakeDB) UpsertObjectWithEvent(ctx context.Context, obj models.Object, kind string) error {
+	if err := f.begin(ctx, "upsert_event", obj.ID); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.upsertLocked(obj)
+	f.events = append(f.events, fmt.Sprintf("%v:%s", obj.ID, kind))
+	return nil
+}
+
+func (f *fakeDB) WithTx(ctx context.Context, fn func(tx pgx.Tx) error) error {
+	return errors.New("transactions are not supported by fakeDB")
+}
+
+func (f *fakeDB) DeleteObjectByID(ctx context.Context, id models.ID) error {
+	if err := f.begin(ctx, "delete", id); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.objects[id]; !ok {
+		return postgres.ErrObjectNotFound
+	}
+	delete(f.objects, id)
+	return nil
+}
+
+func (f *fakeDB) DeleteObjectsByIDs(ctx context.Context, ids []models.ID) (int64, error) {
+	if err := f.begin(ctx, "delete_batch", ids...); err != nil {
+		return 0, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var n int64
+	for _, id := range ids {
+		if _, ok := f.objects[id]; ok {
+			delete(f.objects, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// idLess orders ids like postgres does, shorter ids first
+func idLess(a, b models.ID) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// sortedLocked returns all objects ordered by id
+func (f *fakeDB) sortedLocked() []models.Object {
+	objs := make([]models.Object, 0, len(f.objects))
+	for _, obj := range f.objects {
+		objs = append(objs, obj)
+	}
+	sort.Slice(objs, func(i, j int) bool { return idLess(objs[i].ID, objs[j].ID) })
+	return objs
+}
+
+func (f *fakeDB) GetAll(ctx context.Context) ([]models.Object, error) {
+	if err := f.begin(ctx, "get_all"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sortedLocked(), nil
+}
+
+func (f *fakeDB) GetByID(ctx context.Context, id models.ID) (models.Object, error) {
+	if err := f.begin(ctx, "get_by_id", id); err != nil {
+		return models.Object{}, err
+	}
+	obj, ok := f.get(id)
+	if !ok {
+		return models.Object{}, postgres.ErrObjectNotFound
+	}
+	return obj, nil
+}
+
+func (f *fakeDB) GetPage(ctx context.Context, limit, offset int) ([]models.Object, error) {
+	if err := f.begin(ctx, "get_page"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	objs := f.sortedLocked()
+	if offset >= len(objs) {
+		return nil, nil
+	}
+	objs = objs[offset:]
+	if len(objs) > limit {
+		objs = objs[:limit]
+	}
+	return objs, nil
+}
+
+func (f *fakeDB) GetPageBounds(ctx context.Context, size int) ([]models.ID, error) {
+	if err := f.begin(ctx, "get_page_bounds"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var bounds []models.ID
+	for i, obj := range f.sortedLocked() {
+		if i%size == 0 {
+			bounds = append(bounds, obj.ID)
+		}
+	}
+	return bounds, nil
+}
+
+func (f *fakeDB) GetRange(ctx context.Context, from, to models.ID) ([]models.Object, error) {
+	if err := f.begin(ctx, "get_range", from); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var objs []models.Object
+	for _, obj := range f.sortedLocked() {
+		if !idLess(obj.ID, from) && (to == "" || idLess(obj.ID, to)) {
+			objs = append(objs, obj)
+		}
+	}
+	return objs, nil
+}
+
+func (f *fakeDB) Count(ctx context.Context) (int, error) {
+	if err := f.begin(ctx, "count"); err != nil {
+		return 0, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.objects), nil
+}
+
+func (f *fakeDB) GetModifiedSince(ctx context.Context, since time.Time) ([]models.Object, error) {
+	if err := f.begin(ctx, "get_modified_since"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var objs []models.Object
+	for _, obj := range f.sortedLocked() {
+		if obj.LastSeenAt != nil && !obj.LastSeenAt.Before(since) {
+			objs = append(objs, obj)
+		}
+	}
+	sort.SliceStable(objs, func(i, j int) bool { return objs[i].LastSeenAt.Before(*objs[j].LastSeenAt) })
+	return objs, nil
+}
+
+func (f *fakeDB) ClaimExpired(ctx context.Context, before time.Time, limit int, lockTTL time.Duration) ([]models.Object, error) {
+	if err := f.begin(ctx, "claim_expired"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := f.now()
+	var objs []models.Object
+	for _, obj := range f.sortedLocked() {
+		if len(objs) >= limit {
+			break
+		}
+		if obj.LastSeenAt == nil || !obj.LastSeenAt.Before(before) {
+			continue
+		}
+		if until, ok := f.claimed[obj.ID]; ok && !until.Before(now) {
+			continue
+		}
+		f.claimed[obj.ID] = now.Add(lockTTL)
+		objs = append(objs, obj)
+	}
+	return objs, nil
+}
+
+func (f *fakeDB) ListenDeletes(ctx context.Context, channel string, handle func(id models.ID)) error {
+	if err := f.begin(ctx, "listen"); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&f.listened, 1)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case id := <-f.notify:
+			handle(id)
+		}
+	}
+}
+
+func (f *fakeDB) Ping(ctx context.Context) error {
+	return f.begin(ctx, "ping")
+}
+
+// fakeLogger records every line, with the fields added by With appended
+type fakeLogger struct {
+	mu     *sync.Mutex
+	lines  *[]string
+	fields string
+}
+
+var _ logger.Logger = fakeLogger{}
+
+func newFakeLogger() fakeLogger {
+	return fakeLogger{mu: new(sync.Mutex), lines: new([]string)}
+}
+
+func (l fakeLogger) add(level, msg string) {
+	l.mu.Lock()
+	*l.lines = append(*l.lines, level+" "+msg+l.fields)
+	l.mu.Unlock()
+}
+
+func (l fakeLogger) Warn(msg string, args ...interface{})  { l.add("WARN", fmt.Sprintf(msg, args...)) }
+func (l fakeLogger) Info(msg string, args ...interface{})  { l.add("INFO", fmt.Sprintf(msg, args...)) }
+func (l fakeLogger) Debug(msg string, args ...interface{}) { l.add("DEBUG", fmt.Sprintf(msg, args...)) }
+func (l fakeLogger) Error(err error, keysAndValues ...interface{}) {
+	msg := err.Error()
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		msg += fmt.Sprintf(" %v=%v", keysAndValues[i], keysAndValues[i+1])
+	}
+	l.add("ERROR", msg)
+}
+func (l fakeLogger) With(key string, value interface{}) logger.Logger {
+	return fakeLogger{mu: l.mu, lines: l.lines, fields: fmt.Sprintf("%s %s=%v", l.fields, key, value)}
+}
+
+// all returns the lines logged so far
+func (l fakeLogger) all() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), *l.lines...)
+}
+
+// count returns how many lines of level contain substr, any level when level is empty
+func (l fakeLogger) count(level, substr string) int {
+	n := 0
+	for _, line := range l.all() {
+		if (level == "" || strings.HasPrefix(line, level+" ")) && strings.Contains(line, substr) {
+			n++
+		}
+	}
+	return n
+}
+
+func (l fakeLogger) has(level, substr string) bool {
+	return l.count(level, substr) > 0
+}
+
+// testConfig returns a config with every optional feature disabled and short timeouts
+func testConfig() Config {
+	return Config{
+		MaxObjectsPerRequest: 10,
+		RetentionPolicySec:   60,
+		ColdStartWorkers:     1,
+		HTTP: HttpConfig{
+			ListenPort:   "0",
+			TesterScheme: "http",
+			TesterHost:   "127.0.0.1",
+			TesterPort:   "1", // nothing listens there, tests talking to a tester point the config at one
+			TimeoutSec:   5,
+		},
+	}
+}
+
+func newTestService(t *testing.T, db *fakeDB, cfg Config) (*service, fakeLogger) {
+	t.Helper()
+	log := newFakeLogger()
+	s, err := newService(db, log, cfg)
+	if err != nil {
+		t.Fatalf("newService: %v", err)
+	}
+	return s, log
+}
+
+// useTester points cfg at srv
+func useTester(t *testing.T, cfg *Config, srv *httptest.Server) {
+	t.Helper()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.HTTP.TesterScheme, cfg.HTTP.TesterHost, cfg.HTTP.TesterPort = u.Scheme, host, port
+}
+
+// newTester serves {"id":<id>,"online":<online(id)>} on GET /objects/<id>
+func newTester(t *testing.T, online func(id models.ID) bool) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := models.ID(strings.TrimPrefix(r.URL.Path, "/objects/"))
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(models.Object{ID: id, Online: online(id)})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// runService runs s until the test ends, returning once its routes are registered and the pipeline started.
+// stop cancels Run and returns its error.
+func runService(t *testing.T, s *service) (stop func() error) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+	waitFor(t, "pipeline start", func() bool { return atomic.LoadInt32(&s.started) == 1 })
+	var (
+		once sync.Once
+		err  error
+	)
+	stop = func() error {
+		once.Do(func() {
+			cancel()
+			select {
+			case err = <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatal("Run didn't return after cancelling its context")
+			}
+		})
+		return err
+	}
+	t.Cleanup(func() { _ = stop() })
+	return stop
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// serve runs req against the service router and returns the recorded response
+func serve(s *service, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, req)
+	return rec
+}
+
+func ptrTime(t time.Time) *time.Time {
+	return &t
+}
+
+// fakeIngester passes ids sent on its channel to the pipeline
+type fakeIngester struct {
+	ids     chan models.ID
+	started chan struct{}
+}
+
+func newFakeIngester() *fakeIngester {
+	return &fakeIngester{ids: make(chan models.ID), started: make(chan struct{}, 1)}
+}
+
+func (i *fakeIngester) Start(ctx context.Context, out chan<- models.ID) error {
+	i.started <- struct{}{}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case id := <-i.ids:
+			select {
+			case <-ctx.Done():
+				return nil
+			case out <- id:
+			}
+		}
+	}
+}
+
+// send hands ids to the running ingester
+func (i *fakeIngester) send(t *testing.T, ids ...models.ID) {
+	t.Helper()
+	for _, id := range ids {
+		select {
+		case i.ids <- id:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("ingester didn't take id %v", id)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package service
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	"github.com/poodbooq/bitburst_server/models"
+)
+
+const capturedBodyLimit = 1024
+
+const timeoutBody = `{"error":"request timed out"}`
+
+var (
+	errNoObjectIDs = errors.New("object_ids must not be empty")
+	errEmptyBody   = errors.New("request body is empty")
+)
+
+// maxIDLength bounds string ids, they are stored and logged as they are
+const maxIDLength = 255
+
+// invalidIDError rejects an id the tester can't know
+type invalidIDError struct {
+	id     models.ID
+	reason string
+}
+
+func (e invalidIDError) Error() string {
+	return fmt.Sprintf("object id %q %s", string(e.id), e.reason)
+}
+
+func isInvalidID(err error) bool {
+	_, ok := err.(invalidIDError)
+	return ok
+}
+
+// validateIDs rejects ids other than non-negative integers, or with stringIDs empty and overlong ones
+func validateIDs(ids []models.ID, stringIDs bool) error {
+	for _, id := range ids {
+		if err := validateID(id, stringIDs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateID(id models.ID, stringIDs bool) error {
+	switch {
+	case stringIDs && id == "":
+		return invalidIDError{id: id, reason: "must not be empty"}
+	case stringIDs && len(id) > maxIDLength:
+		return invalidIDError{id: id, reason: fmt.Sprintf("must not be longer than %v bytes", maxIDLength)}
+	case stringIDs:
+		return nil
+	case !id.IsInt() || strings.HasPrefix(string(id), "-"):
+		return invalidIDError{id: id, reason: "must be a non-negative integer"}
+	}
+	return nil
+}
+
+// bodyTooLarge reports whether err comes from reading past an http.MaxBytesReader limit
+func bodyTooLarge(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "http: request body too large")
+}
+
+// openBody returns the request body, transparently decompressing gzip encoded ones
+func openBody(r *http.Request) (io.ReadCloser, error) {
+	if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		return gzip.NewReader(r.Body)
+	}
+	return ioutil.NopCloser(r.Body), nil
+}
+
+// decodeBody decodes a JSON request body, transparently decompressing gzip encoded ones.
+// When capture is not nil it also receives the decoded (decompressed) bytes read from the body.
+// In strict mode fields missing from v are rejected instead of ignored.
+func decodeBody(r *http.Request, v interface{}, capture io.Writer, strict bool) error {
+	rc, err := openBody(r)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	body := io.Reader(rc)
+	if capture != nil {
+		body = io.TeeReader(body, capture)
+	}
+	dec := json.NewDecoder(body)
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	return dec.Decode(v)
+}
+
+// unknownField returns the name of the offending field when err was caused by
+// a strict decoder meeting a field it doesn't know
+func unknownField(err error) (string, bool) {
+	const prefix = "json: unknown field "
+	if err == nil || !strings.HasPrefix(err.Error(), prefix) {
+		return "", false
+	}
+	return strings.Trim(strings.TrimPrefix(err.Error(), prefix), `"`), true
+}
+
+func isNDJSON(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/x-ndjson"
+}
+
+// decodeNDJSON calls handle with the ids of every value in the body as soon as it is decoded,
+// accepting both ObjectsInput objects and bare ids. It returns how many ids were handled,
+// stopping at the first error of handle.
+func decodeNDJSON(r *http.Request, handle func(ids []models.ID) error, strict bool) (int, error) {
+	rc, err := openBody(r)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	var (
+		n   int
+		dec = json.NewDecoder(rc)
+	)
+	for {
+		var raw json.RawMessage
+		if err = dec.Decode(&raw); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		var ids []models.ID
+		if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '{' {
+			var input models.ObjectsInput
+			lineDec := json.NewDecoder(bytes.NewReader(raw))
+			if strict {
+				lineDec.DisallowUnknownFields()
+			}
+			if err = lineDec.Decode(&input); err != nil {
+				return n, err
+			}
+			ids = input.ObjectIDs
+		} else {
+			var id models.ID
+			if err = json.Unmarshal(raw, &id); err != nil {
+				return n, err
+			}
+			ids = []models.ID{id}
+		}
+		if err = handle(ids); err != nil {
+			return n, err
+		}
+		n += len(ids)
+	}
+}
+
+// cappedBuffer keeps only the first limit bytes written to it, silently discarding the rest
+type cappedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); room > 0 {
+		if len(p) > room {
+			b.Buffer.Write(p[:room])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// gzipWriter compresses everything written to the response it wraps
+type gzipWriter struct {
+	http.ResponseWriter
+	zw *gzip.Writer
+}
+
+func (w gzipWriter) Write(p []byte) (int, error) {
+	return w.zw.Write(p)
+}
+
+// gzipResponse compresses the responses of next for clients accepting gzip, leaving others plain
+func (s *service) gzipResponse(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			next(w, r, ps)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Del("Content-Length")
+		zw := gzip.NewWriter(w)
+		defer func() {
+			if err := zw.Close(); err != nil {
+				s.log.Error(err)
+			}
+		}()
+		next(gzipWriter{ResponseWriter: w, zw: zw}, r, ps)
+	}
+}
+
+// withTimeout answers requests next doesn't finish within timeoutMs with 503, cancelling their context.
+// A non-positive timeoutMs leaves next unbounded.
+func withTimeout(timeoutMs int, next httprouter.Handle) httprouter.Handle {
+	if timeoutMs <= 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { next(w, r, ps) })
+		http.TimeoutHandler(h, time.Duration(timeoutMs)*time.Millisecond, timeoutBody).ServeHTTP(w, r)
+	}
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name := strings.TrimSpace(enc)
+		if i := strings.IndexByte(name, ';'); i >= 0 {
+			if strings.TrimSpace(name[i+1:]) == "q=0" {
+				continue
+			}
+			name = strings.TrimSpace(name[:i])
+		}
+		if strings.EqualFold(name, "gzip") {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *service) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.log.Error(err)
+	}
+}
+
+func (s *service) writeError(w http.ResponseWriter, status int, msg string) {
+	s.writeJSON(w, status, models.ErrorResponse{Error: msg})
+}
+
+func (s *service) handleFallbackRoutes(_ context.Context) {
+	s.router.NotFound = http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		s.writeError(w, http.StatusNotFound, "not found")
+	})
+	s.router.HandleMethodNotAllowed = true
+	s.router.MethodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		// the router has already set the Allow header to the methods registered for the path
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	})
+}
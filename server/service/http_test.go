@@ -0,0 +1,214 @@
+package service
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/poodbooq/bitburst_server/models"
+)
+
+func TestWrongMethodAnswers405WithAllow(t *testing.T) {
+	s, _ := newTestService(t, newFakeDB(), testConfig())
+	s.registerRoutes(context.Background())
+	rec := serve(s, httptest.NewRequest(http.MethodGet, "/callback", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET /callback answered %v, want 405", rec.Code)
+	}
+	allow := rec.Header().Get("Allow")
+	if !strings.Contains(allow, http.MethodPost) || strings.Contains(allow, http.MethodGet) {
+		t.Fatalf("GET /callback allowed %q, want POST only", allow)
+	}
+	var body models.ErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error != "method not allowed" {
+		t.Fatalf("405 body %s isn't the JSON error envelope: %v", rec.Body, err)
+	}
+}
+
+func TestUnknownPathAnswersJSON404(t *testing.T) {
+	s, _ := newTestService(t, newFakeDB(), testConfig())
+	s.registerRoutes(context.Background())
+	rec := serve(s, httptest.NewRequest(http.MethodGet, "/no/such/path", nil))
+	if rec.Code != http.StatusNotFound || !strings.HasPrefix(rec.Header().Get("Content-Type"), "application/json") {
+		t.Fatalf("unknown path answered %v with %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var body models.ErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error != "not found" {
+		t.Fatalf("404 body %s isn't the JSON error envelope: %v", rec.Body, err)
+	}
+}
+
+func TestObjectsModifiedSinceBoundary(t *testing.T) {
+	since := time.Date(2021, 3, 1, 12, 0, 0, 500, time.UTC)
+	before, after := since.Add(-time.Nanosecond), since.Add(time.Nanosecond)
+	db := newFakeDB(
+		models.Object{ID: "1", LastSeenAt: &after, Online: true},
+		models.Object{ID: "2", LastSeenAt: &since, Online: true},
+		models.Object{ID: "3", LastSeenAt: &before, Online: true},
+		models.Object{ID: "4", Online: true}, // never seen
+	)
+	s, _ := newTestService(t, db, testConfig())
+	s.registerRoutes(context.Background())
+
+	for _, tc := range []struct {
+		since string
+		want  []models.ID
+	}{
+		{since.Format(time.RFC3339Nano), []models.ID{"2", "1"}},
+		{since.In(time.FixedZone("UTC+2", 2*60*60)).Format(time.RFC3339Nano), []models.ID{"2", "1"}}, // same instant in another zone
+		{after.Format(time.RFC3339Nano), []models.ID{"1"}},
+		{after.Add(time.Nanosecond).Format(time.RFC3339Nano), []models.ID{}},
+	} {
+		rec := serve(s, httptest.NewRequest(http.MethodGet, "/objects?modified_since="+url.QueryEscape(tc.since), nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("modified_since=%s answered %v: %s", tc.since, rec.Code, rec.Body)
+		}
+		var objs []models.Object
+		if err := json.Unmarshal(rec.Body.Bytes(), &objs); err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]models.ID, len(objs))
+		for i := range objs {
+			ids[i] = objs[i].ID
+		}
+		if !reflect.DeepEqual(ids, tc.want) {
+			t.Errorf("modified_since=%s returned %v, want %v", tc.since, ids, tc.want)
+		}
+	}
+
+	if rec := serve(s, httptest.NewRequest(http.MethodGet, "/objects?modified_since=yesterday", nil)); rec.Code != http.StatusBadRequest {
+		t.Errorf("unparsable modified_since answered %v, want 400", rec.Code)
+	}
+}
+
+func TestLabelsStoredAndExposed(t *testing.T) {
+	label := "boiler room"
+	tester := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		obj := models.Object{ID: models.ID(strings.TrimPrefix(r.URL.Path, "/objects/")), Online: true}
+		if obj.ID == "1" {
+			obj.Label = &label
+		}
+		_ = json.NewEncoder(w).Encode(obj)
+	}))
+	t.Cleanup(tester.Close)
+
+	for _, store := range []bool{false, true} {
+		cfg := testConfig()
+		useTester(t, &cfg, tester)
+		cfg.SkipColdStart = true
+		cfg.StoreLabels = store
+		db := newFakeDB()
+		s, _ := newTestService(t, db, cfg)
+		ingester := newFakeIngester()
+		s.SetIngester(ingester)
+		runService(t, s)
+		<-ingester.started
+		ingester.send(t, "1", "2")
+		waitFor(t, "objects stored", func() bool { return db.has("1") && db.has("2") })
+
+		rec := serve(s, httptest.NewRequest(http.MethodGet, "/objects/1", nil))
+		var obj models.Object
+		if err := json.Unmarshal(rec.Body.Bytes(), &obj); err != nil {
+			t.Fatalf("GET /objects/1 answered %v: %s", rec.Code, rec.Body)
+		}
+		switch {
+		case store && (obj.Label == nil || *obj.Label != label):
+			t.Errorf("stored label not exposed: %s", rec.Body)
+		case !store && obj.Label != nil:
+			t.Errorf("label stored with STORE_LABELS off: %s", rec.Body)
+		}
+
+		rec = serve(s, httptest.NewRequest(http.MethodGet, "/objects/2", nil))
+		if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), `"label"`) {
+			t.Errorf("object without a label answered %v: %s", rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestObjectsGzippedOnRequest(t *testing.T) {
+	seen := time.Now().UTC()
+	db := newFakeDB(
+		models.Object{ID: "1", LastSeenAt: &seen, Online: true},
+		models.Object{ID: "2", LastSeenAt: &seen, Online: true},
+	)
+	for _, tc := range []struct {
+		compress, accept bool
+		timeoutMs        int
+	}{
+		{true, true, 0}, {true, true, 1000}, {true, false, 0}, {false, true, 0},
+	} {
+		cfg := testConfig()
+		cfg.HTTP.CompressObjects = tc.compress
+		cfg.HTTP.ObjectsTimeoutMs = tc.timeoutMs
+		s, _ := newTestService(t, db, cfg)
+		s.registerRoutes(context.Background())
+		req := httptest.NewRequest(http.MethodGet, "/objects", nil)
+		if tc.accept {
+			req.Header.Set("Accept-Encoding", "gzip")
+		}
+		rec := serve(s, req)
+
+		body := io.Reader(rec.Body)
+		gzipped := rec.Header().Get("Content-Encoding") == "gzip"
+		if want := tc.compress && tc.accept; gzipped != want {
+			t.Fatalf("%+v: response gzipped=%v, want %v", tc, gzipped, want)
+		}
+		if gzipped {
+			zr, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatalf("%+v: %v", tc, err)
+			}
+			body = zr
+		}
+		var objs []models.Object
+		if err := json.NewDecoder(body).Decode(&objs); err != nil || len(objs) != 2 {
+			t.Fatalf("%+v: decoded %v objects: %v", tc, len(objs), err)
+		}
+		if tc.compress && rec.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%+v: Vary is %q, caches would mix encodings", tc, rec.Header().Get("Vary"))
+		}
+		if rec.Code != http.StatusOK || rec.Header().Get("X-Total-Count") != "2" {
+			t.Errorf("%+v: answered %v with X-Total-Count %q", tc, rec.Code, rec.Header().Get("X-Total-Count"))
+		}
+	}
+}
+
+func TestSlowObjectsQueryTimesOut(t *testing.T) {
+	db := newFakeDB()
+	cancelled := make(chan struct{})
+	db.setHook(func(ctx context.Context, op string, ids []models.ID) error {
+		if op == "count" {
+			<-ctx.Done() // a query stuck on a locked table
+			close(cancelled)
+			return ctx.Err()
+		}
+		return nil
+	})
+	cfg := testConfig()
+	cfg.HTTP.ObjectsTimeoutMs = 100
+	s, _ := newTestService(t, db, cfg)
+	s.registerRoutes(context.Background())
+
+	start := time.Now()
+	rec := serve(s, httptest.NewRequest(http.MethodGet, "/objects", nil))
+	elapsed := time.Since(start)
+	if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != timeoutBody {
+		t.Fatalf("slow /objects answered %v: %s", rec.Code, rec.Body)
+	}
+	if elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Errorf("timed out after %v, want about 100ms", elapsed)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("the slow query's context wasn't cancelled")
+	}
+}
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/poodbooq/bitburst_server/models"
+)
+
+const (
+	uuidOnline  models.ID = "3f2b8c1e-9a4d-4e6f-8b7a-1c2d3e4f5a6b"
+	uuidOffline models.ID = "9e8d7c6b-5a4f-4e3d-8c2b-1a0f9e8d7c6b"
+)
+
+func TestStringIDsFlowThroughPipeline(t *testing.T) {
+	tester := newTester(t, func(id models.ID) bool { return id == uuidOnline })
+	cfg := testConfig()
+	cfg.StringIDs = true
+	useTester(t, &cfg, tester)
+	seen := time.Now().UTC().Add(-time.Second)
+	db := newFakeDB(models.Object{ID: uuidOffline, LastSeenAt: &seen, Online: true})
+	s, _ := newTestService(t, db, cfg)
+	ingester := newFakeIngester()
+	s.SetIngester(ingester)
+	runService(t, s)
+
+	<-ingester.started
+	ingester.send(t, uuidOnline, uuidOffline)
+	waitFor(t, "uuid objects to be persisted", func() bool { return db.has(uuidOnline) && !db.has(uuidOffline) })
+
+	rec := serve(s, httptest.NewRequest(http.MethodGet, "/objects/"+string(uuidOnline), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /objects/<uuid> answered %v: %s", rec.Code, rec.Body)
+	}
+	var obj models.Object
+	if err := json.Unmarshal(rec.Body.Bytes(), &obj); err != nil || obj.ID != uuidOnline || !obj.Online {
+		t.Fatalf("GET /objects/<uuid> returned %+v, %v", obj, err)
+	}
+	if !strings.Contains(rec.Body.String(), `"id":"`+string(uuidOnline)+`"`) {
+		t.Fatalf("uuid not encoded as a JSON string: %s", rec.Body)
+	}
+}
+
+func TestIntegerIDsStayNumbers(t *testing.T) {
+	s, _ := newTestService(t, newFakeDB(models.Object{ID: "42", Online: true}), testConfig())
+	s.registerRoutes(context.Background())
+	rec := serve(s, httptest.NewRequest(http.MethodGet, "/objects/42", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"id":42`) {
+		t.Fatalf("GET /objects/42 answered %v: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestIntegerModeRejectsStringIDs(t *testing.T) {
+	s, _ := newTestService(t, newFakeDB(), testConfig())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.registerRoutes(ctx)
+	s.setCallbackTarget(ctx, make(chan models.ID, 10))
+
+	for _, body := range []string{`{"object_ids":["` + string(uuidOnline) + `"]}`, `{"object_ids":[-1]}`, `{"object_ids":["007"]}`} {
+		rec := serve(s, httptest.NewRequest(http.MethodPost, "/callback", strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "must be a non-negative integer") {
+			t.Errorf("callback %s answered %v: %s", body, rec.Code, rec.Body)
+		}
+	}
+	rec := serve(s, httptest.NewRequest(http.MethodGet, "/objects/"+string(uuidOnline), nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("GET /objects/<uuid> answered %v in integer mode, want 400", rec.Code)
+	}
+}
+
+func TestStringModeRejectsEmptyAndOverlongIDs(t *testing.T) {
+	if err := validateIDs([]models.ID{uuidOnline, "42"}, true); err != nil {
+		t.Fatalf("valid string ids rejected: %v", err)
+	}
+	for _, id := range []models.ID{"", models.ID(strings.Repeat("x", maxIDLength+1))} {
+		if err := validateIDs([]models.ID{id}, true); !isInvalidID(err) {
+			t.Errorf("id of %v bytes accepted, got %v", len(id), err)
+		}
+	}
+}
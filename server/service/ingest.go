@@ -0,0 +1,49 @@
+package service
+
+import (
+	"context"
+
+	"github.com/poodbooq/bitburst_server/models"
+)
+
+// Ingester receives object ids over some transport and passes them to out until ctx is done
+type Ingester interface {
+	Start(ctx context.Context, out chan<- models.ID) error
+}
+
+// SetIngester replaces the default HTTP /callback ingester, it has to be called before Run
+func (s *service) SetIngester(ingester Ingester) {
+	if s == nil {
+		return
+	}
+	s.ingester = ingester
+}
+
+// httpIngester accepts ids POSTed to /callback on the service's router
+type httpIngester struct {
+	s *service
+}
+
+func (i httpIngester) Start(ctx context.Context, out chan<- models.ID) error {
+	i.s.setCallbackTarget(ctx, out)
+	<-ctx.Done()
+	return nil
+}
+
+// ingest runs the ingester, passing every id it produces on to the pipeline
+func (s *service) ingest(ctx context.Context) {
+	ids := make(chan models.ID, cap(s.inputCh))
+	go func() {
+		if err := s.ingester.Start(ctx, ids); err != nil {
+			s.log.Error(err)
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case id := <-ids:
+			s.enqueue(ctx, id)
+		}
+	}
+}
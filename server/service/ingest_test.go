@@ -0,0 +1,99 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/poodbooq/bitburst_server/models"
+)
+
+func TestCallbackRouteRegisteredOncePerInstance(t *testing.T) {
+	s, _ := newTestService(t, newFakeDB(), testConfig())
+	s.registerRoutes(context.Background())
+	s.registerRoutes(context.Background()) // must not panic on the duplicate route
+
+	rec := serve(s, httptest.NewRequest(http.MethodPost, "/callback", strings.NewReader(`{"object_ids":[1]}`)))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("callback before the ingester started answered %v, want 503", rec.Code)
+	}
+
+	other, _ := newTestService(t, newFakeDB(), testConfig())
+	other.registerRoutes(context.Background()) // a second instance has its own router
+}
+
+func TestCallbackRoutesToLatestIngesterRun(t *testing.T) {
+	s, _ := newTestService(t, newFakeDB(), testConfig())
+	s.registerRoutes(context.Background())
+	ingester := httpIngester{s: s}
+
+	firstCtx, stopFirst := context.WithCancel(context.Background())
+	first := make(chan models.ID, 1)
+	firstDone := make(chan struct{})
+	go func() {
+		defer close(firstDone)
+		_ = ingester.Start(firstCtx, first)
+	}()
+	waitFor(t, "first ingester run", func() bool { return s.callbackTargetOut() == chan<- models.ID(first) })
+	stopFirst()
+	<-firstDone
+
+	secondCtx, stopSecond := context.WithCancel(context.Background())
+	defer stopSecond()
+	second := make(chan models.ID, 1)
+	go func() { _ = ingester.Start(secondCtx, second) }()
+	waitFor(t, "second ingester run", func() bool { return s.callbackTargetOut() == chan<- models.ID(second) })
+
+	rec := serve(s, httptest.NewRequest(http.MethodPost, "/callback", strings.NewReader(`{"object_ids":[7]}`)))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("callback answered %v: %s", rec.Code, rec.Body)
+	}
+	select {
+	case id := <-second:
+		if id != "7" {
+			t.Fatalf("latest run received id %v, want 7", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("latest ingester run didn't receive the callback id")
+	}
+	if len(first) != 0 {
+		t.Fatal("stopped ingester run received the callback id")
+	}
+}
+
+// callbackTargetOut returns the channel /callback currently passes ids to
+func (s *service) callbackTargetOut() chan<- models.ID {
+	s.callbackMu.Lock()
+	defer s.callbackMu.Unlock()
+	if s.callback == nil {
+		return nil
+	}
+	return s.callback.out
+}
+
+func TestFakeIngesterFeedsPipeline(t *testing.T) {
+	cfg := testConfig()
+	useTester(t, &cfg, newTester(t, func(id models.ID) bool { return id != "3" }))
+	cfg.SkipColdStart = true
+	seen := time.Now().UTC()
+	db := newFakeDB(models.Object{ID: "3", LastSeenAt: &seen, Online: true})
+	s, _ := newTestService(t, db, cfg)
+	ingester := newFakeIngester()
+	s.SetIngester(ingester)
+	runService(t, s)
+	<-ingester.started
+
+	ingester.send(t, "1", "2", "3")
+	waitFor(t, "ids fed by the ingester to be persisted", func() bool {
+		return db.has("1") && db.has("2") && !db.has("3") && s.timerCount() == 2
+	})
+
+	// the HTTP ingester was replaced, so /callback isn't routed at all
+	rec := serve(s, httptest.NewRequest(http.MethodPost, "/callback", strings.NewReader(`{"object_ids":[4]}`)))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("/callback answered %v with a replaced ingester, want 404", rec.Code)
+	}
+}
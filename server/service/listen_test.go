@@ -0,0 +1,51 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/poodbooq/bitburst_server/models"
+)
+
+func TestNotifyDeletesObject(t *testing.T) {
+	seen := time.Now().UTC()
+	db := newFakeDB(models.Object{ID: "7", LastSeenAt: &seen, Online: true})
+	cfg := testConfig()
+	cfg.DeleteNotifyChannel = "objects_deleted"
+	s, log := newTestService(t, db, cfg)
+	runService(t, s)
+	waitFor(t, "timer armed at cold start", func() bool { return s.timerCount() == 1 })
+
+	db.notify <- "abc"
+	waitFor(t, "invalid payload to be logged", func() bool { return log.has("ERROR", "ignoring payload on channel objects_deleted") })
+	db.notify <- "7"
+	waitFor(t, "notified object to be deleted", func() bool { return !db.has("7") && s.timerCount() == 0 })
+	if !log.has("INFO", "reason="+string(reasonExternal)) {
+		t.Errorf("external delete not logged with its reason:\n%s", log.all())
+	}
+}
+
+func TestNotifyHandoffStopsWithContext(t *testing.T) {
+	db := newFakeDB()
+	cfg := testConfig()
+	cfg.DeleteNotifyChannel = "objects_deleted"
+	s, _ := newTestService(t, db, cfg)
+	for len(s.deleteCh) < cap(s.deleteCh) { // nothing drains deleteCh, so the next handoff blocks
+		s.deleteCh <- task{obj: models.Object{ID: "1"}}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.listenExternalDeletes(ctx)
+		close(done)
+	}()
+	db.notify <- "8"
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("listener stuck handing a delete to a full channel after its context was done")
+	}
+}
@@ -0,0 +1,128 @@
+package service
+
+import (
+	"github.com/poodbooq/bitburst_server/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	statusOnline  = "online"
+	statusOffline = "offline"
+	statusError   = "error"
+
+	deleteDeleted = "deleted"
+	deleteAbsent  = "absent"
+)
+
+// deleteSources maps delete reasons to the source label of object_deletes_by_source_total
+var deleteSources = map[deleteReason]string{
+	reasonColdStart: "coldstart",
+	reasonExpired:   "timer",
+	reasonOffline:   "offline",
+	reasonExternal:  "external",
+}
+
+type serviceMetrics struct {
+	registry *metrics.Metrics
+
+	callbacks       prometheus.Counter
+	upserts         prometheus.Counter
+	upsertsDropped  prometheus.Counter
+	testerErrors    prometheus.Counter
+	timersCreated   prometheus.Counter
+	timersRefreshed prometheus.Counter
+	observations    *prometheus.CounterVec
+	deletes         *prometheus.CounterVec
+	deletesBySource *prometheus.CounterVec
+	transitions     *prometheus.CounterVec
+	dbErrors        *prometheus.CounterVec
+	retriesSkipped  prometheus.Counter
+
+	callbackToPersist prometheus.Histogram
+	testerLatency     prometheus.Histogram
+}
+
+func newServiceMetrics(registry *metrics.Metrics) *serviceMetrics {
+	return &serviceMetrics{
+		registry: registry,
+		callbacks: registry.NewCounter(prometheus.CounterOpts{
+			Name: "callbacks_received_total",
+			Help: "Requests received on /callback, including rejected ones.",
+		}),
+		upserts: registry.NewCounter(prometheus.CounterOpts{
+			Name: "object_upserts_total",
+			Help: "Objects written to the database by successful upserts.",
+		}),
+		upsertsDropped: registry.NewCounter(prometheus.CounterOpts{
+			Name: "object_upserts_dropped_total",
+			Help: "Rows of a failed batch upsert that failed again on their own and were dropped, there is no dead-letter queue yet.",
+		}),
+		testerErrors: registry.NewCounter(prometheus.CounterOpts{
+			Name: "tester_request_errors_total",
+			Help: "Tester requests that failed or returned an unreadable response.",
+		}),
+		timersCreated: registry.NewCounter(prometheus.CounterOpts{
+			Name: "expiration_timers_created_total",
+			Help: "Expiration timers armed for ids that were not tracked yet.",
+		}),
+		timersRefreshed: registry.NewCounter(prometheus.CounterOpts{
+			Name: "expiration_timers_refreshed_total",
+			Help: "Expiration timers reset because their id was received again before expiring.",
+		}),
+		observations: registry.NewCounterVec(prometheus.CounterOpts{
+			Name: "object_observations_total",
+			Help: "Tester lookups by observed object status (online, offline or error).",
+		}, []string{"status"}),
+		deletes: registry.NewCounterVec(prometheus.CounterOpts{
+			Name: "object_deletes_total",
+			Help: "Object deletes by result, absent when there was no row left to delete.",
+		}, []string{"result"}),
+		deletesBySource: registry.NewCounterVec(prometheus.CounterOpts{
+			Name: "object_deletes_by_source_total",
+			Help: "Object deletes sent to the database by what triggered them (coldstart, timer, offline or external).",
+		}, []string{"source"}),
+		transitions: registry.NewCounterVec(prometheus.CounterOpts{
+			Name: "object_transitions_total",
+			Help: "Changes of an object's observed state compared to its last known one.",
+		}, []string{"from", "to"}),
+		dbErrors: registry.NewCounterVec(prometheus.CounterOpts{
+			Name: "db_errors_total",
+			Help: "Failed database write attempts by operation and kind, deadline when the attempt ran out of time.",
+		}, []string{"op", "kind"}),
+		retriesSkipped: registry.NewCounter(prometheus.CounterOpts{
+			Name: "retries_skipped_total",
+			Help: "Retries given up because the shared retry budget was exhausted.",
+		}),
+		callbackToPersist: registry.NewHistogram(prometheus.HistogramOpts{
+			Name:    "callback_to_persist_seconds",
+			Help:    "Time from an id being accepted at /callback until its upsert or delete completed.",
+			Buckets: prometheus.ExponentialBuckets(0.05, 2, 10), // 50ms .. ~25s, tester lookups alone take up to a few seconds
+		}),
+		testerLatency: registry.NewHistogram(prometheus.HistogramOpts{
+			Name:    "tester_request_duration_seconds",
+			Help:    "Time until the tester answered a lookup with response headers, failed requests included.",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 12), // 5ms .. ~10s
+		}),
+	}
+}
+
+// registerServiceGauges exposes gauges reading the state of s directly
+func (m *serviceMetrics) registerServiceGauges(s *service) {
+	m.registry.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "cold_start_completed",
+		Help: "1 once stored objects were handed to the pipeline at startup, 0 before.",
+	}, func() float64 {
+		if s.ColdStartDone() {
+			return 1
+		}
+		return 0
+	})
+	m.registry.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "expiration_timers_active",
+		Help: "Expiration timers currently armed.",
+	}, func() float64 {
+		s.timers.mu.Lock()
+		defer s.timers.mu.Unlock()
+		return float64(len(s.timers.byID))
+	})
+}
@@ -0,0 +1,169 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/poodbooq/bitburst_server/models"
+)
+
+func TestTimerCreateAndRefreshCounters(t *testing.T) {
+	s, _, clock, ingester := startWithFakeClock(t, testConfig())
+	ingester.send(t, "1", "2")
+	waitFor(t, "timers of both objects", func() bool { return s.timerCount() == 2 })
+	clock.Advance(time.Second)
+	ingester.send(t, "1")
+	waitFor(t, "timer refresh", func() bool { return counterValue(t, s.metrics.timersRefreshed) == 1 })
+
+	if n := counterValue(t, s.metrics.timersCreated); n != 2 {
+		t.Fatalf("counted %v created timers, want 2", n)
+	}
+}
+
+func TestObservationsCountedByStatus(t *testing.T) {
+	tester := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/objects/")
+		if id == "3" {
+			http.Error(w, "tester broke", http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(models.Object{ID: models.ID(id), Online: id == "1"})
+	}))
+	defer tester.Close()
+	cfg := testConfig()
+	useTester(t, &cfg, tester)
+	cfg.SkipColdStart = true
+	s, _ := newTestService(t, newFakeDB(), cfg)
+	ingester := newFakeIngester()
+	s.SetIngester(ingester)
+	runService(t, s)
+	<-ingester.started
+
+	ingester.send(t, "1", "2", "3", "1")
+	observed := func(status string) float64 { return counterValue(t, s.metrics.observations.WithLabelValues(status)) }
+	waitFor(t, "every lookup to be counted", func() bool {
+		return observed(statusOnline)+observed(statusOffline)+observed(statusError) == 4
+	})
+	if on, off, failed := observed(statusOnline), observed(statusOffline), observed(statusError); on != 2 || off != 1 || failed != 1 {
+		t.Fatalf("counted %v online, %v offline and %v failed observations, want 2, 1 and 1", on, off, failed)
+	}
+}
+
+func TestCallbackToPersistLatencyObserved(t *testing.T) {
+	cfg := testConfig()
+	useTester(t, &cfg, newTester(t, func(id models.ID) bool { return id != "3" }))
+	cfg.SkipColdStart = true
+	seen := time.Now().UTC()
+	db := newFakeDB(models.Object{ID: "3", LastSeenAt: &seen, Online: true})
+	db.setHook(func(ctx context.Context, op string, ids []models.ID) error {
+		time.Sleep(20 * time.Millisecond) // every write takes a while
+		return nil
+	})
+	s, _ := newTestService(t, db, cfg)
+	ingester := newFakeIngester()
+	s.SetIngester(ingester)
+	runService(t, s)
+	<-ingester.started
+
+	ingester.send(t, "1", "2", "3") // two upserts and a delete
+	waitFor(t, "latency of every write", func() bool {
+		count, _ := histogramValue(t, s.metrics.callbackToPersist)
+		return count == 3
+	})
+	_, sum := histogramValue(t, s.metrics.callbackToPersist)
+	if sum < 3*0.02 || sum > 3*5 {
+		t.Fatalf("3 writes of at least 20ms took %vs from callback to persistence", sum)
+	}
+}
+
+func TestLatencyObservedOnlyForPersistedBatchRows(t *testing.T) {
+	s, _ := newTestService(t, newFakeDB(), testConfig())
+	observedAt := time.Now()
+	s.observations.accept("1", observation{at: observedAt, online: true})
+	s.observations.accept("2", observation{at: observedAt.Add(time.Second), online: true}) // newer than the batch's tasks
+	batch := func() []task {
+		acceptedAt := observedAt.Add(-time.Second)
+		return []task{
+			{obj: models.Object{ID: "1", Online: true}, acceptedAt: acceptedAt, observedAt: observedAt},
+			{obj: models.Object{ID: "2", Online: true}, acceptedAt: acceptedAt, observedAt: observedAt},
+		}
+	}
+
+	s.upsertBatch(context.Background(), batch())
+	if count, _ := histogramValue(t, s.metrics.callbackToPersist); count != 1 {
+		t.Fatalf("batch upsert observed %v latencies, want only the written row's", count)
+	}
+	s.deleteBatch(context.Background(), batch())
+	if count, _ := histogramValue(t, s.metrics.callbackToPersist); count != 2 {
+		t.Fatalf("%v latencies after the batch delete, want one more for the deleted row", count)
+	}
+}
+
+func TestMetricsSummaryLoggedOnInterval(t *testing.T) {
+	cfg := testConfig()
+	cfg.MetricsLogIntervalSec = 30
+	s, _, clock, ingester := startWithFakeClock(t, cfg)
+	log := s.log.(fakeLogger)
+	waitFor(t, "summary ticker", func() bool { return clock.pending() == 1 })
+	ingester.send(t, "1", "2")
+	waitFor(t, "timers of both objects", func() bool { return s.timerCount() == 2 })
+
+	clock.Advance(29 * time.Second)
+	time.Sleep(20 * time.Millisecond)
+	if log.has("INFO", "metrics: ") {
+		t.Fatal("summary logged before its interval ran out")
+	}
+	clock.Advance(time.Second)
+	waitFor(t, "first summary", func() bool { return log.count("INFO", "metrics: ") == 1 })
+	for _, field := range []string{"expiration_timers_created_total=2", `observations_total{status="online"}=2`, "callback_to_persist_seconds_count="} {
+		if !log.has("INFO", field) {
+			t.Errorf("summary lacks %s:\n%s", field, strings.Join(log.all(), "\n"))
+		}
+	}
+	clock.Advance(30 * time.Second)
+	waitFor(t, "second summary", func() bool { return log.count("INFO", "metrics: ") == 2 })
+}
+
+func TestDeletesCountedBySource(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	expired, fresh := clock.Now().UTC().Add(-2*time.Hour), clock.Now().UTC()
+	db := newFakeDB(
+		models.Object{ID: "1", LastSeenAt: &expired, Online: true},
+		models.Object{ID: "2", LastSeenAt: &expired, Online: true},
+		models.Object{ID: "3", LastSeenAt: &fresh, Online: true},
+		models.Object{ID: "4", LastSeenAt: &fresh, Online: true},
+	)
+	cfg := testConfig()
+	useTester(t, &cfg, newTester(t, func(id models.ID) bool { return id != "4" }))
+	cfg.DeleteMetricsBySource = true
+	s, _ := newTestService(t, db, cfg)
+	s.SetClock(clock)
+	ingester := newFakeIngester()
+	s.SetIngester(ingester)
+	runService(t, s)
+	<-ingester.started
+
+	bySource := func(source string) float64 { return counterValue(t, s.metrics.deletesBySource.WithLabelValues(source)) }
+	waitFor(t, "cold start to delete the expired objects", func() bool {
+		return s.ColdStartDone() && !db.has("1") && !db.has("2") && s.timerCount() == 2
+	})
+	ingester.send(t, "4")
+	waitFor(t, "offline object to be deleted", func() bool { return !db.has("4") })
+	clock.Advance(s.retention())
+	waitFor(t, "timer to expire the last object", func() bool { return !db.has("3") })
+
+	want := map[string]float64{"coldstart": 2, "offline": 1, "timer": 1}
+	waitFor(t, "deletes counted by source", func() bool {
+		for source, n := range want {
+			if bySource(source) != n {
+				return false
+			}
+		}
+		return true
+	})
+}
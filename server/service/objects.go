@@ -0,0 +1,106 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/poodbooq/bitburst_server/models"
+	"github.com/poodbooq/bitburst_server/postgres"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// handleObjectsRoute serves stored objects page by page, modified since a timestamp for
+// incremental downstream syncs, and single objects by id
+func (s *service) handleObjectsRoute(_ context.Context) {
+	handle := func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		raw := r.URL.Query().Get("modified_since")
+		if raw == "" {
+			s.serveObjectsPage(w, r)
+			return
+		}
+		since, err := time.Parse(time.RFC3339Nano, raw)
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, "modified_since must be an RFC 3339 timestamp")
+			return
+		}
+		objs, err := s.database.GetModifiedSince(r.Context(), since.UTC())
+		if err != nil {
+			s.log.Error(err)
+			s.writeError(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+		if objs == nil {
+			objs = []models.Object{}
+		}
+		s.writeJSON(w, http.StatusOK, objs)
+	}
+	if s.cfg.HTTP.CompressObjects {
+		handle = s.gzipResponse(handle)
+	}
+	s.router.GET("/objects", withTimeout(s.cfg.HTTP.ObjectsTimeoutMs, handle))
+	s.router.GET("/objects/:id", withTimeout(s.cfg.HTTP.ObjectsTimeoutMs, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		id := models.ID(ps.ByName("id"))
+		if err := validateID(id, s.cfg.StringIDs); err != nil {
+			s.writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		obj, err := s.database.GetByID(r.Context(), id)
+		switch {
+		case err == postgres.ErrObjectNotFound:
+			s.writeError(w, http.StatusNotFound, fmt.Sprintf("object %v not found", id))
+		case err != nil:
+			s.log.Error(err)
+			s.writeError(w, http.StatusInternalServerError, "internal error")
+		default:
+			s.writeJSON(w, http.StatusOK, obj)
+		}
+	}))
+}
+
+// serveObjectsPage answers GET /objects?limit=&offset= with one page of objects ordered by id,
+// reporting the number of all stored objects in X-Total-Count
+func (s *service) serveObjectsPage(w http.ResponseWriter, r *http.Request) {
+	limit, err := queryInt(r, "limit", defaultPageLimit)
+	if err != nil || limit < 1 || limit > maxPageLimit {
+		s.writeError(w, http.StatusBadRequest, fmt.Sprintf("limit must be an integer between 1 and %v", maxPageLimit))
+		return
+	}
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil || offset < 0 {
+		s.writeError(w, http.StatusBadRequest, "offset must be a non-negative integer")
+		return
+	}
+	total, err := s.database.Count(r.Context())
+	if err != nil {
+		s.log.Error(err)
+		s.writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	objs, err := s.database.GetPage(r.Context(), limit, offset)
+	if err != nil {
+		s.log.Error(err)
+		s.writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if objs == nil {
+		objs = []models.Object{}
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	s.writeJSON(w, http.StatusOK, objs)
+}
+
+func queryInt(r *http.Request, name string, def int) (int, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return def, nil
+	}
+	return strconv.Atoi(raw)
+}
@@ -0,0 +1,226 @@
+package service
+
+import (
+	"context"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/poodbooq/bitburst_server/models"
+)
+
+// tracked reports whether s still holds an observation or a timer for id
+func (s *service) tracked(id models.ID) (observed, timed bool) {
+	s.observations.mu.Lock()
+	_, observed = s.observations.byID[id]
+	s.observations.mu.Unlock()
+	s.timers.mu.Lock()
+	_, timed = s.timers.byID[id]
+	s.timers.mu.Unlock()
+	return observed, timed
+}
+
+func TestOfflineDeleteForgetsObservationAndTimer(t *testing.T) {
+	cfg := testConfig()
+	var (
+		mu     sync.Mutex
+		online = true
+	)
+	useTester(t, &cfg, newTester(t, func(models.ID) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return online
+	}))
+	cfg.SkipColdStart = true
+	db := newFakeDB()
+	s, _ := newTestService(t, db, cfg)
+	ingester := newFakeIngester()
+	s.SetIngester(ingester)
+	runService(t, s)
+	<-ingester.started
+
+	ingester.send(t, "1")
+	waitFor(t, "online object to be tracked", func() bool {
+		observed, timed := s.tracked("1")
+		return db.has("1") && observed && timed
+	})
+	mu.Lock()
+	online = false
+	mu.Unlock()
+	ingester.send(t, "1")
+	waitFor(t, "offline object to be deleted and forgotten", func() bool {
+		observed, timed := s.tracked("1")
+		return !db.has("1") && !observed && !timed
+	})
+}
+
+func TestStaleUpsertAfterDeleteIsSkipped(t *testing.T) {
+	now := time.Now().UTC()
+	db := newFakeDB(models.Object{ID: "1", LastSeenAt: &now, Online: true})
+	s, _ := newTestService(t, db, testConfig())
+	older, newer := now.Add(time.Second), now.Add(2*time.Second)
+	s.observations.accept("1", observation{at: older, online: true})
+	s.observations.accept("1", observation{at: newer, online: false})
+
+	s.deleteObject(context.Background(), task{obj: models.Object{ID: "1"}, reason: reasonOffline, observedAt: newer})
+	if observed, _ := s.tracked("1"); observed || db.has("1") {
+		t.Fatalf("delete left the row (%v) or its observation (%v) behind", db.has("1"), observed)
+	}
+	s.upsertObject(context.Background(), task{obj: models.Object{ID: "1", LastSeenAt: &older, Online: true}, observedAt: older})
+	if db.has("1") {
+		t.Fatal("upsert observed before the delete resurrected the object")
+	}
+}
+
+func TestConcurrentObservationsEndConsistent(t *testing.T) {
+	cfg := testConfig()
+	useTester(t, &cfg, newTester(t, func(models.ID) bool { return rand.Intn(2) == 0 }))
+	cfg.SkipColdStart = true
+	cfg.MaxConcurrentFetches = 8
+	db := newFakeDB()
+	s, _ := newTestService(t, db, cfg)
+	ingester := newFakeIngester()
+	s.SetIngester(ingester)
+	runService(t, s)
+	<-ingester.started
+
+	const ids, rounds = 5, 20
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := 0; r < rounds; r++ {
+				ingester.ids <- models.ID(strconv.Itoa(r%ids + 1))
+			}
+		}()
+	}
+	wg.Wait()
+	// every id ends either stored, observed online and timed, or gone without anything tracked
+	waitFor(t, "tracking to agree with the database", func() bool {
+		for i := 1; i <= ids; i++ {
+			id := models.ID(strconv.Itoa(i))
+			observed, timed := s.tracked(id)
+			stored := db.has(id)
+			if stored != observed || stored != timed {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestInterleavedWritesOfOneIDEndDeterministic(t *testing.T) {
+	cfg := testConfig()
+	cfg.SkipColdStart = true
+	db := newFakeDB()
+	var (
+		mu                sync.Mutex
+		inFlight, overlap int
+	)
+	db.setHook(func(ctx context.Context, op string, ids []models.ID) error {
+		mu.Lock()
+		inFlight++
+		if inFlight > 1 {
+			overlap++
+		}
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return nil
+	})
+	s, _ := newTestService(t, db, cfg)
+	runService(t, s)
+
+	base := time.Now().UTC()
+	for round := 0; round < 10; round++ {
+		latestOnline := round%2 == 0
+		var tasks []task
+		for i := 0; i < 6; i++ {
+			at := base.Add(time.Duration(round*10+i) * time.Second)
+			online := i%2 == 0
+			if i == 5 {
+				online = latestOnline
+			}
+			s.observations.accept("1", observation{at: at, online: online})
+			seen := at
+			tasks = append(tasks, task{obj: models.Object{ID: "1", LastSeenAt: &seen, Online: online}, reason: reasonOffline, observedAt: at})
+		}
+		rand.Shuffle(len(tasks), func(i, j int) { tasks[i], tasks[j] = tasks[j], tasks[i] })
+		for _, tk := range tasks {
+			if tk.obj.Online {
+				s.upsertCh <- tk
+			} else {
+				s.deleteCh <- tk
+			}
+		}
+		latest := base.Add(time.Duration(round*10+5) * time.Second)
+		waitFor(t, "the newest write to win", func() bool {
+			obj, stored := db.get("1")
+			if !latestOnline {
+				return !stored
+			}
+			return stored && obj.LastSeenAt.Equal(latest)
+		})
+		time.Sleep(20 * time.Millisecond) // let the stale writes of the round finish
+		if obj, stored := db.get("1"); stored != latestOnline || (stored && !obj.LastSeenAt.Equal(latest)) {
+			t.Fatalf("round %v ended with stored=%v %+v, want the newest observation (online=%v)", round, stored, obj, latestOnline)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if overlap != 0 {
+		t.Fatalf("%v writes of the same id overlapped", overlap)
+	}
+}
+
+func TestTransitionsTrackedAgainstLastKnownState(t *testing.T) {
+	states := []bool{true, false, true, true, false}
+	var next int32
+	tester := newTester(t, func(models.ID) bool { return states[atomic.AddInt32(&next, 1)-1] })
+	cfg := testConfig()
+	useTester(t, &cfg, tester)
+	cfg.SkipColdStart = true
+	cfg.TrackTransitions = true
+	cfg.UpsertOffline = true // offline objects stay known instead of being forgotten with their row
+	db := newFakeDB()
+	s, log := newTestService(t, db, cfg)
+	ingester := newFakeIngester()
+	s.SetIngester(ingester)
+	runService(t, s)
+	<-ingester.started
+
+	for i := range states {
+		ingester.send(t, "1")
+		waitFor(t, "observation to be persisted", func() bool { return db.callCount("upsert") == i+1 })
+	}
+
+	var got []string
+	for _, line := range log.all() {
+		if i := strings.Index(line, "object id=1 went "); i >= 0 {
+			got = append(got, strings.SplitN(line[i+len("object id=1 went "):], ",", 2)[0])
+		}
+	}
+	if want := []string{"online -> offline", "offline -> online", "online -> offline"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("logged transitions %v, want %v", got, want)
+	}
+	for _, tc := range []struct {
+		from, to string
+		want     float64
+	}{
+		{statusOnline, statusOffline, 2},
+		{statusOffline, statusOnline, 1},
+		{statusOnline, statusOnline, 0},
+	} {
+		if n := counterValue(t, s.metrics.transitions.WithLabelValues(tc.from, tc.to)); n != tc.want {
+			t.Errorf("object_transitions_total{from=%q,to=%q} = %v, want %v", tc.from, tc.to, n, tc.want)
+		}
+	}
+}
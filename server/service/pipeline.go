@@ -0,0 +1,86 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/poodbooq/bitburst_server/models"
+)
+
+// backlog remembers when every task still waiting in inputCh was queued, to report the pipeline lag
+type backlog struct {
+	mu     *sync.Mutex
+	seq    uint64
+	queued map[uint64]time.Time
+}
+
+// add records a task about to be queued, returning the sequence number to pass to done
+func (b *backlog) add(at time.Time) uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	b.queued[b.seq] = at
+	return b.seq
+}
+
+func (b *backlog) done(seq uint64) {
+	b.mu.Lock()
+	delete(b.queued, seq)
+	b.mu.Unlock()
+}
+
+// oldest returns when the longest waiting task was queued, false if none is waiting
+func (b *backlog) oldest() (time.Time, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var oldest time.Time
+	for _, at := range b.queued {
+		if oldest.IsZero() || at.Before(oldest) {
+			oldest = at
+		}
+	}
+	return oldest, !oldest.IsZero()
+}
+
+// queue stamps t for lag tracking right before it is sent to inputCh
+func (s *service) queue(t task) task {
+	t.seq = s.backlog.add(s.clock.Now())
+	return t
+}
+
+// busy counts a pipeline worker goroutine as active until the returned func is called
+func (s *service) busy() func() {
+	atomic.AddInt64(&s.activeWorkers, 1)
+	return func() { atomic.AddInt64(&s.activeWorkers, -1) }
+}
+
+func (s *service) handlePipelineRoute(_ context.Context) {
+	s.router.GET("/pipeline", withTimeout(s.cfg.HTTP.AdminTimeoutMs, func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+		s.writeJSON(w, http.StatusOK, s.pipelineStatus())
+	}))
+}
+
+func (s *service) pipelineStatus() models.PipelineStatus {
+	status := models.PipelineStatus{
+		Channels: map[string]int{
+			"input":      len(s.inputCh),
+			"coalesce":   len(s.coalesceCh),
+			"upsert":     len(s.upsertCh),
+			"delete":     len(s.deleteCh),
+			"expiration": len(s.expirationCh),
+		},
+		ActiveWorkers: atomic.LoadInt64(&s.activeWorkers),
+	}
+	if oldest, ok := s.backlog.oldest(); ok {
+		status.OldestQueuedAt = &oldest
+		status.LagSec = s.clock.Now().Sub(oldest).Seconds()
+	}
+	s.timers.mu.Lock()
+	status.Timers = len(s.timers.byID)
+	s.timers.mu.Unlock()
+	return status
+}
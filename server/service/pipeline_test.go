@@ -0,0 +1,393 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/poodbooq/bitburst_server/models"
+)
+
+func TestConfirmationFetchKeepsObjectOnline(t *testing.T) {
+	var requests int32
+	tester := newTester(t, func(models.ID) bool {
+		return atomic.AddInt32(&requests, 1) > 1 // a transient offline blip on the first lookup
+	})
+	cfg := testConfig()
+	useTester(t, &cfg, tester)
+	cfg.SkipColdStart = true
+	cfg.ConfirmOffline = true
+	cfg.ConfirmOfflineDelayMs = 10
+	seen := time.Now().UTC()
+	db := newFakeDB(models.Object{ID: "1", LastSeenAt: &seen, Online: true})
+	s, log := newTestService(t, db, cfg)
+	ingester := newFakeIngester()
+	s.SetIngester(ingester)
+	runService(t, s)
+	<-ingester.started
+
+	ingester.send(t, "1")
+	waitFor(t, "confirmed object to be upserted", func() bool { return db.callCount("upsert") == 1 })
+	if n := atomic.LoadInt32(&requests); n != 2 || !log.has("DEBUG", "id=1 reported offline, confirming before delete") {
+		t.Fatalf("offline report wasn't confirmed, %v tester requests:\n%s", n, log.all())
+	}
+	if db.callCount("delete") != 0 || !db.has("1") {
+		t.Fatal("object deleted although the confirmation found it online")
+	}
+}
+
+func TestCallbacksWithinWindowCoalesce(t *testing.T) {
+	cfg := testConfig()
+	cfg.CallbackCoalesceMs = 100
+	s, db, clock, ingester := startWithFakeClock(t, cfg)
+	log := s.log.(fakeLogger)
+
+	ingester.send(t, "1", "2") // three chatty callbacks repeating ids
+	ingester.send(t, "2", "3")
+	ingester.send(t, "1")
+	waitFor(t, "callbacks to wait for the window", func() bool {
+		return len(s.coalesceCh) == 0 && clock.pending() == 1
+	})
+	time.Sleep(20 * time.Millisecond) // the last callback's ids may still be merging
+	if n := db.callCount("upsert"); n != 0 {
+		t.Fatalf("%v ids processed before the window closed", n)
+	}
+
+	clock.Advance(100 * time.Millisecond)
+	waitFor(t, "coalesced ids to be stored", func() bool { return db.has("1") && db.has("2") && db.has("3") })
+	if n := log.count("DEBUG", "flushing batch of"); n != 1 || !log.has("DEBUG", "flushing batch of 3 coalesced ids") {
+		t.Fatalf("callbacks weren't flushed as one batch of 3 ids:\n%s", log.all())
+	}
+	if n := db.callCount("upsert"); n != 3 {
+		t.Fatalf("%v upserts for 3 distinct ids", n)
+	}
+}
+
+func TestCoalescedFlushCancelledLeavesNoBacklog(t *testing.T) {
+	cfg := testConfig()
+	cfg.CallbackCoalesceMs = 100
+	s, _ := newTestService(t, newFakeDB(), cfg)
+	clock := newFakeClock(time.Now())
+	s.SetClock(clock)
+	for len(s.inputCh) < cap(s.inputCh) { // nothing reads inputCh, so the flush blocks
+		s.inputCh <- task{}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.coalesceCallbacks(ctx)
+	}()
+
+	s.coalesceCh <- []task{{obj: models.Object{ID: "1"}, acceptedAt: clock.Now()}}
+	waitFor(t, "flush window", func() bool { return clock.pending() == 1 })
+	clock.Advance(100 * time.Millisecond)
+	waitFor(t, "flush to block on the full input channel", func() bool {
+		_, queued := s.backlog.oldest()
+		return queued
+	})
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("coalescing didn't stop with its context")
+	}
+	if oldest, queued := s.backlog.oldest(); queued {
+		t.Fatalf("id never delivered to the pipeline still counts towards the lag, queued at %v", oldest)
+	}
+}
+
+func TestDeleteOfMissingRowReported(t *testing.T) {
+	cfg := testConfig()
+	useTester(t, &cfg, newTester(t, func(models.ID) bool { return false }))
+	cfg.SkipColdStart = true
+	db := newFakeDB() // nothing stored, so the offline delete matches no row
+	s, log := newTestService(t, db, cfg)
+	ingester := newFakeIngester()
+	s.SetIngester(ingester)
+	runService(t, s)
+	<-ingester.started
+
+	ingester.send(t, "1")
+	waitFor(t, "delete attempt", func() bool { return db.callCount("delete") == 1 })
+	waitFor(t, "absent delete to be counted", func() bool {
+		return counterValue(t, s.metrics.deletes.WithLabelValues(deleteAbsent)) == 1
+	})
+	if n := counterValue(t, s.metrics.deletes.WithLabelValues(deleteDeleted)); n != 0 {
+		t.Fatalf("counted %v real deletes for a missing row", n)
+	}
+	if !log.has("DEBUG", "object with id 1 was already absent, nothing deleted") || log.has("ERROR", "") {
+		t.Fatalf("missing row not reported as absent:\n%s", strings.Join(log.all(), "\n"))
+	}
+}
+
+func TestProcessingDeadlineAbortsSlowWrite(t *testing.T) {
+	cfg := testConfig()
+	useTester(t, &cfg, newTester(t, func(models.ID) bool { return true }))
+	cfg.SkipColdStart = true
+	cfg.ProcessingTimeoutSec = 1
+	db := newFakeDB()
+	aborted := make(chan error, 1)
+	db.setHook(func(ctx context.Context, op string, ids []models.ID) error {
+		if op != "upsert" {
+			return nil
+		}
+		select {
+		case <-ctx.Done(): // a database that never answers
+			aborted <- ctx.Err()
+			return ctx.Err()
+		case <-time.After(10 * time.Second):
+			return nil
+		}
+	})
+	s, log := newTestService(t, db, cfg)
+	ingester := newFakeIngester()
+	s.SetIngester(ingester)
+	runService(t, s)
+	<-ingester.started
+
+	start := time.Now()
+	ingester.send(t, "1")
+	select {
+	case err := <-aborted:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("slow upsert ended with %v, want %v", err, context.DeadlineExceeded)
+		}
+		if took := time.Since(start); took > 3*time.Second {
+			t.Fatalf("1s processing deadline aborted the upsert after %v", took)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("processing deadline didn't abort the slow upsert")
+	}
+	waitFor(t, "aborted upsert to be logged", func() bool { return log.has("ERROR", "deadline exceeded") })
+	if db.has("1") {
+		t.Fatal("aborted upsert stored the object")
+	}
+}
+
+func TestEveryDeletePathLogsItsReason(t *testing.T) {
+	cfg := testConfig()
+	useTester(t, &cfg, newTester(t, func(id models.ID) bool { return id != "3" }))
+	now := time.Now().UTC()
+	expired, fresh := now.Add(-time.Hour), now.Add(-time.Second)
+	db := newFakeDB(
+		models.Object{ID: "1", LastSeenAt: &expired, Online: true},
+		models.Object{ID: "2", LastSeenAt: &fresh, Online: true},
+	)
+	s, log := newTestService(t, db, cfg)
+	clock := newFakeClock(now)
+	s.SetClock(clock)
+	ingester := newFakeIngester()
+	s.SetIngester(ingester)
+	runService(t, s)
+	<-ingester.started
+
+	waitFor(t, "cold start", func() bool { return s.ColdStartDone() && s.timerCount() == 1 && !db.has("1") })
+	ingester.send(t, "3")
+	waitFor(t, "offline delete", func() bool { return db.callCount("delete") == 2 })
+	clock.Advance(s.retention())
+	waitFor(t, "expired delete", func() bool { return !db.has("2") })
+
+	for id, reason := range map[string]deleteReason{"1": reasonColdStart, "2": reasonExpired, "3": reasonOffline} {
+		if !log.has("INFO", "deleting object id="+id+", reason="+string(reason)+", ") {
+			t.Errorf("delete of %v not logged with reason %s", id, reason)
+		}
+	}
+	if t.Failed() {
+		t.Log(strings.Join(log.all(), "\n"))
+	}
+}
+
+func TestUpsertOfflineKeepsOfflineObjects(t *testing.T) {
+	var online int32 = 1
+	tester := newTester(t, func(models.ID) bool { return atomic.LoadInt32(&online) == 1 })
+	cfg := testConfig()
+	useTester(t, &cfg, tester)
+	cfg.SkipColdStart = true
+	cfg.UpsertOffline = true
+	db := newFakeDB()
+	s, _ := newTestService(t, db, cfg)
+	ingester := newFakeIngester()
+	s.SetIngester(ingester)
+	runService(t, s)
+	<-ingester.started
+
+	ingester.send(t, "1")
+	waitFor(t, "online object stored with a timer", func() bool { _, timed := s.tracked("1"); return db.has("1") && timed })
+	first, _ := db.get("1")
+
+	atomic.StoreInt32(&online, 0)
+	ingester.send(t, "1")
+	waitFor(t, "offline observation to be upserted", func() bool { return db.callCount("upsert") == 2 })
+	obj, ok := db.get("1")
+	if !ok {
+		t.Fatal("offline object deleted with UPSERT_OFFLINE set")
+	}
+	if obj.Online {
+		t.Error("offline object kept with online=true")
+	}
+	if obj.LastSeenAt == nil || !obj.LastSeenAt.After(*first.LastSeenAt) {
+		t.Errorf("last_seen_at = %v, want one fresher than the online sighting at %v", formatTime(obj.LastSeenAt), formatTime(first.LastSeenAt))
+	}
+	if _, timed := s.tracked("1"); timed {
+		t.Error("offline object kept its expiration timer")
+	}
+	if n := db.callCount("delete") + db.callCount("delete_batch"); n != 0 {
+		t.Errorf("%v deletes issued with UPSERT_OFFLINE set", n)
+	}
+}
+
+func TestUpsertOfflineKeepsOfflineObjectsAtColdStart(t *testing.T) {
+	seen := time.Now().UTC().Add(-time.Second)
+	db := newFakeDB(
+		models.Object{ID: "1", LastSeenAt: &seen, Online: true},
+		models.Object{ID: "2", LastSeenAt: &seen, Online: false},
+	)
+	cfg := testConfig()
+	cfg.UpsertOffline = true
+	s, log := newTestService(t, db, cfg)
+	runService(t, s)
+
+	waitFor(t, "cold start", s.ColdStartDone)
+	waitFor(t, "online object's timer", func() bool { _, timed := s.tracked("1"); return timed })
+	if !db.has("2") {
+		t.Fatal("offline object deleted at cold start with UPSERT_OFFLINE set")
+	}
+	if _, timed := s.tracked("2"); timed {
+		t.Error("offline object got an expiration timer")
+	}
+	if !log.has("DEBUG", "keeping offline object id=2") {
+		t.Errorf("kept offline object not logged:\n%s", strings.Join(log.all(), "\n"))
+	}
+}
+
+func TestPipelineLogsTagObjectID(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		cfg := testConfig()
+		cfg.LogObjectID = enabled
+		s, db, clock, ingester := startWithFakeClock(t, cfg)
+		log := s.log.(fakeLogger)
+		ingester.send(t, "1")
+		waitFor(t, "object stored with a timer", func() bool { return db.has("1") && s.timerCount() == 1 })
+		clock.Advance(s.retention())
+		waitFor(t, "expired object deleted", func() bool { return !db.has("1") })
+		waitFor(t, "delete logged", func() bool { return log.has("DEBUG", "deleted object with id 1") })
+
+		for _, stage := range []struct{ level, msg string }{
+			{"DEBUG", "got info for id=1"},          // retrieveObjects
+			{"DEBUG", "upserting object: id=1"},     // handleUpsert
+			{"DEBUG", "set new timer for id 1"},     // handleObjectsExpiration
+			{"INFO", "deleting object id=1"},        // expiration
+			{"DEBUG", "deleted object with id 1 ("}, // handleDelete
+		} {
+			line := lineWith(log, stage.level, stage.msg)
+			switch {
+			case line == "":
+				t.Errorf("%q not logged:\n%s", stage.msg, strings.Join(log.all(), "\n"))
+			case enabled && !strings.HasSuffix(line, " object_id=1"):
+				t.Errorf("%q lacks the object_id field: %s", stage.msg, line)
+			case !enabled && strings.Contains(line, "object_id="):
+				t.Errorf("%q tagged with object_id while LOG_OBJECT_ID is off: %s", stage.msg, line)
+			}
+		}
+	}
+}
+
+// lineWith returns the first line of level logged containing substr
+func lineWith(log fakeLogger, level, substr string) string {
+	for _, line := range log.all() {
+		if strings.HasPrefix(line, level+" ") && strings.Contains(line, substr) {
+			return line
+		}
+	}
+	return ""
+}
+
+func TestPipelineLagReflectsDelayedItem(t *testing.T) {
+	release := make(chan struct{})
+	tester := newTester(t, func(id models.ID) bool {
+		if id == "1" {
+			<-release // holds the only fetch worker
+		}
+		return true
+	})
+	var once sync.Once
+	unblock := func() { once.Do(func() { close(release) }) }
+	t.Cleanup(unblock) // before the tester closes, which waits for the held request
+	cfg := testConfig()
+	useTester(t, &cfg, tester)
+	cfg.SkipColdStart = true
+	cfg.MaxConcurrentFetches = 1
+	db := newFakeDB()
+	s, _ := newTestService(t, db, cfg)
+	clock := newFakeClock(time.Now())
+	s.SetClock(clock)
+	ingester := newFakeIngester()
+	s.SetIngester(ingester)
+	runService(t, s)
+	<-ingester.started
+
+	ingester.send(t, "1")
+	waitFor(t, "fetch worker to take the first id", func() bool { return s.pipelineStatus().ActiveWorkers == 1 })
+	clock.Advance(2 * time.Second)
+	queuedAt := clock.Now()
+	ingester.send(t, "2")
+	waitFor(t, "second id to wait in the input channel", func() bool { return s.pipelineStatus().Channels["input"] == 1 })
+	clock.Advance(5 * time.Second)
+
+	rec := serve(s, httptest.NewRequest(http.MethodGet, "/pipeline", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /pipeline answered %v: %s", rec.Code, rec.Body)
+	}
+	var status models.PipelineStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.LagSec != 5 || status.OldestQueuedAt == nil || !status.OldestQueuedAt.Equal(queuedAt) {
+		t.Errorf("lag %vs since %v, want 5s since %v", status.LagSec, status.OldestQueuedAt, queuedAt)
+	}
+	if status.ActiveWorkers != 1 || status.Channels["input"] != 1 {
+		t.Errorf("status %+v, want 1 active worker and 1 queued id", status)
+	}
+
+	unblock()
+	waitFor(t, "both ids stored", func() bool { return db.has("1") && db.has("2") })
+	if status = s.pipelineStatus(); status.OldestQueuedAt != nil || status.LagSec != 0 {
+		t.Errorf("lag %vs since %v with nothing queued", status.LagSec, status.OldestQueuedAt)
+	}
+}
+
+func TestRepeatedOfflineDeletesSuppressedWithinCooldown(t *testing.T) {
+	cfg := testConfig()
+	useTester(t, &cfg, newTester(t, func(models.ID) bool { return false }))
+	cfg.SkipColdStart = true
+	cfg.DeleteCooldownMs = 1000
+	db := newFakeDB()
+	s, log := newTestService(t, db, cfg)
+	clock := newFakeClock(time.Now())
+	s.SetClock(clock)
+	ingester := newFakeIngester()
+	s.SetIngester(ingester)
+	runService(t, s)
+	<-ingester.started
+
+	ingester.send(t, "1")
+	waitFor(t, "first delete", func() bool { return db.callCount("delete") == 1 })
+	for i := 1; i <= 3; i++ {
+		ingester.send(t, "1")
+		waitFor(t, "repeated delete to be skipped", func() bool { return log.count("DEBUG", "skipping delete of id=1") == i })
+	}
+	if n := db.callCount("delete"); n != 1 {
+		t.Fatalf("%v deletes of id=1 within the cooldown, want 1", n)
+	}
+
+	clock.Advance(time.Second)
+	ingester.send(t, "1")
+	waitFor(t, "delete after the cooldown", func() bool { return db.callCount("delete") == 2 })
+}
@@ -0,0 +1,42 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/poodbooq/bitburst_server/receipts"
+)
+
+func newReceiptSink(cfg Config) receipts.Sink {
+	if cfg.ReceiptsURL == "" {
+		return receipts.NewNoop()
+	}
+	return receipts.NewHTTP(cfg.ReceiptsURL, &http.Client{Timeout: time.Duration(cfg.HTTP.TimeoutSec) * time.Second})
+}
+
+// SetReceiptSink sends deletion receipts to sink instead of ReceiptsURL. Deletes read the sink
+// without synchronization, so it can only be swapped before Run.
+func (s *service) SetReceiptSink(sink receipts.Sink) {
+	if s == nil {
+		return
+	}
+	s.receipts = sink
+}
+
+// emitReceipt records the delete of t with the receipt sink
+func (s *service) emitReceipt(ctx context.Context, t task, deletedAt time.Time) {
+	actor := "service"
+	if t.reason == reasonExternal {
+		actor = "external"
+	}
+	err := s.receipts.Emit(ctx, receipts.Receipt{
+		ObjectID:  t.obj.ID,
+		Reason:    string(t.reason),
+		DeletedAt: deletedAt,
+		Actor:     actor,
+	})
+	if err != nil {
+		s.objectLog(t.obj.ID).Error(err)
+	}
+}
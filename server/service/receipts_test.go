@@ -0,0 +1,74 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/poodbooq/bitburst_server/models"
+	"github.com/poodbooq/bitburst_server/receipts"
+)
+
+type fakeSink struct {
+	mu   sync.Mutex
+	byID map[models.ID]receipts.Receipt
+}
+
+func (f *fakeSink) Emit(_ context.Context, receipt receipts.Receipt) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.byID[receipt.ObjectID] = receipt
+	return nil
+}
+
+func (f *fakeSink) get(id models.ID) (receipts.Receipt, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	receipt, ok := f.byID[id]
+	return receipt, ok
+}
+
+func TestEveryDeletePathEmitsItsReason(t *testing.T) {
+	cfg := testConfig()
+	useTester(t, &cfg, newTester(t, func(id models.ID) bool { return id != "2" }))
+	cfg.SkipColdStart = true
+	cfg.DeleteNotifyChannel = "objects_deleted"
+	seen := time.Now().UTC()
+	db := newFakeDB(
+		models.Object{ID: "2", LastSeenAt: &seen, Online: true},
+		models.Object{ID: "3", LastSeenAt: &seen, Online: true},
+	)
+	s, _ := newTestService(t, db, cfg)
+	clock := newFakeClock(time.Now())
+	s.SetClock(clock)
+	sink := &fakeSink{byID: make(map[models.ID]receipts.Receipt)}
+	s.SetReceiptSink(sink)
+	ingester := newFakeIngester()
+	s.SetIngester(ingester)
+	runService(t, s)
+	<-ingester.started
+
+	ingester.send(t, "1")
+	waitFor(t, "timer of object 1", func() bool { return db.has("1") && s.timerCount() == 1 })
+	clock.Advance(s.retention())
+	ingester.send(t, "2") // reported offline
+	waitFor(t, "listener", func() bool { return db.callCount("listen") == 1 })
+	db.notify <- "3"
+
+	for _, want := range []struct {
+		id     models.ID
+		reason deleteReason
+		actor  string
+	}{
+		{"1", reasonExpired, "service"},
+		{"2", reasonOffline, "service"},
+		{"3", reasonExternal, "external"},
+	} {
+		waitFor(t, "receipt of object "+string(want.id), func() bool { _, ok := sink.get(want.id); return ok })
+		got, _ := sink.get(want.id)
+		if got.Reason != string(want.reason) || got.Actor != want.actor || got.DeletedAt.IsZero() {
+			t.Errorf("receipt of object %v = %+v, want reason %v by %v", want.id, got, want.reason, want.actor)
+		}
+	}
+}
@@ -2,108 +2,641 @@ package service
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"net/http"
+	"runtime"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	"github.com/poodbooq/bitburst_server/events"
 	"github.com/poodbooq/bitburst_server/logger"
+	"github.com/poodbooq/bitburst_server/metrics"
 	"github.com/poodbooq/bitburst_server/models"
 	"github.com/poodbooq/bitburst_server/postgres"
+	"github.com/poodbooq/bitburst_server/receipts"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/time/rate"
 )
 
+// readyPingTimeout bounds the postgres ping of a readiness probe, so probes fail instead of piling up
+const readyPingTimeout = 2 * time.Second
+
+// extremeMaxObjectsPerRequest is where MaxObjectsPerRequest starts to cost noticeable memory and connections
+const extremeMaxObjectsPerRequest = 10000
+
 type Config struct {
-	MaxObjectsPerRequest int
-	RetentionPolicySec   int
-	HTTP                 HttpConfig
+	MaxObjectsPerRequest  int
+	ChannelBufferSize     int // capacity of the pipeline channels, 0 uses MaxObjectsPerRequest
+	RetentionPolicySec    int
+	MinRetentionSec       int  // floor for the effective retention, 0 disables it
+	MaxRetentionSec       int  // ceiling for the effective retention, 0 disables it
+	CallbackDebugEcho     bool // echo accepted ids with a generated batch id in the /callback response
+	ConfirmOffline        bool // re-fetch objects reported offline once more before deleting them
+	ConfirmOfflineDelayMs int
+	CallbackCoalesceMs    int    // merge ids of callbacks received within this window into one batch, 0 disables it
+	DeleteNotifyChannel   string // postgres channel whose NOTIFY payloads are ids to delete, empty disables listening
+	BackfillSource        string // file path or http(s) URL listing ids, one per line, fed through the pipeline at startup, empty disables it
+	SkipColdStart         bool   // start fresh without reading stored objects, for stateless deployments or when another instance reconciles them
+	MaxConcurrentFetches  int    // workers looking ids up at the tester, 0 uses MaxObjectsPerRequest
+	ColdStartWorkers      int    // goroutines feeding cold started objects into the pipeline concurrently
+	ColdStartBatchSize    int    // objects fed between scheduler yields during cold start, 0 disables yielding
+	ColdStartPageSize     int    // stored objects are read in pages of this size during cold start, 0 reads them in one query
+	ColdStartMaxQueries   int    // page queries cold start may have in flight at once
+	ColdStartRetries      int    // attempts repeated after a failed cold start query, waiting twice as long after each
+	ColdStartBackoffMs    int    // wait before the first repeated attempt
+
+	StrictCallbackFields      bool   // reject callbacks carrying fields the service doesn't know with 400 instead of ignoring them
+	CaptureMalformedCallbacks bool   // debug only, logs the truncated raw body of callbacks that fail to decode
+	EventsURL                 string // object state changes are POSTed here as JSON events, empty disables publishing
+	ReceiptsURL               string // a JSON deletion receipt is POSTed here for every deleted object, empty disables them
+	ProcessingTimeoutSec      int    // deadline for fetching and persisting one id, beyond the tester request timeout, 0 disables it
+	UpsertBatchSize           int    // upserts are collected and written together once this many are pending, 1 or less writes each right away
+	UpsertFlushMs             int    // longest a collected upsert waits for its batch to fill up
+	DeleteBatchSize           int    // deletes are deferred and flushed together once this many are pending, 1 or less deletes each right away
+	DeleteFlushMs             int    // longest a deferred delete waits for its batch to fill up
+	DeleteCooldownMs          int    // offline observations of an id within this long after its last delete don't delete it again, 0 disables it
+
+	RejectCallbacksDuringColdStart bool // answer callbacks with 503 until cold start completed
+	CallbackEnqueueTimeoutSec      int  // longest a callback waits for the pipeline to take its ids before dropping them, 0 waits until shutdown
+	MaxConcurrentCallbacks         int  // callbacks beyond this many still being processed are answered with 503, 0 disables the bound
+	MaxCallbackBodyBytes           int  // callback bodies larger than this are answered with 413, 0 disables the bound
+	DBTimeoutMs                    int  // deadline of a single upsert or delete attempt, 0 leaves only the processing deadline
+	DBDeadlineRetries              int  // attempts repeated after one ran out of DBTimeoutMs
+	WorkerShards                   int  // persist objects on this many workers picked by a hash of the id instead of a goroutine per write, 0 disables sharding
+	DBMaxConcurrentWrites          int  // upserts and deletes in flight at once, the pipeline backs up beyond it, 0 disables the bound
+	DebugEndpoints                 bool // expose /debug/* diagnostics, /pause, /resume, /resync and /log/level, never enable this on a public listener
+	ExposeConfig                   bool // serve the effective service config on /config, with credentials in URLs redacted
+	RetryBudget                    int  // retries the whole pipeline may spend in a burst, 0 leaves retries unlimited
+	RetryBudgetRefillPerSec        int
+	LogObjectID                    bool // tag log lines of the pipeline stages with a structured object_id field
+	ShutdownTimeoutSec             int  // Run gives up draining after this long on shutdown and returns an error, 0 waits forever
+	DrainDelaySec                  int  // on SIGTERM callbacks are refused and /ready fails this long before shutdown begins, 0 shuts down right away
+	StoreLabels                    bool // persist the optional label of tester responses, so operators can tell objects apart
+	TrackTransitions               bool // log and count online/offline transitions against the last known state of each object
+	DeleteMetricsBySource          bool // count deletes by source (cold start, timer, offline, external) in a separate metric
+	MetricsLogIntervalSec          int  // log a summary of all metrics this often, 0 disables it
+	RecordObservations             bool // insert an object_events row with every upsert, in the same transaction
+	UpsertOffline                  bool // keep offline objects as rows with online=false instead of deleting them, leaving their removal to a separate cleanup
+	StringIDs                      bool // accept any non-empty string up to maxIDLength as object id, e.g. UUIDs, instead of only non-negative integers
+	HTTP                           HttpConfig
 }
 
 type HttpConfig struct {
-	ListenPort string
-	TesterPort string
-	TesterHost string
-	TimeoutSec int
+	ListenPort     string
+	TesterScheme   string
+	TesterMethod   string // GET requests /objects/<id>, POST sends {"id": <id>} to /objects
+	TesterPort     string
+	TesterHost     string
+	TesterCertFile string // client certificate presented to the tester for mutual TLS
+	TesterKeyFile  string
+	TesterCAFile   string // CA bundle the tester's certificate is verified against
+	TimeoutSec     int
+
+	TesterInsecureSkipVerify bool // dev only, accepts self-signed tester certificates
+	StrictTesterResponse     bool // reject tester responses with data after the JSON object instead of ignoring it
+	TesterDisableRedirects   bool // fail tester requests answered with a redirect instead of following it
+	TesterRPS                int  // tester requests started per second across all workers, 0 disables the limit
+	TesterBurst              int  // requests that may start at once after an idle period, at least 1
+	FetchMaxRetries          int  // attempts repeated after a tester request failed with a network error or 5xx, waiting twice as long after each
+	FetchBackoffBaseMs       int  // wait before the first repeated attempt, randomized by up to half
+	CompressObjects          bool // gzip /objects responses for clients sending Accept-Encoding: gzip
+	ObjectsTimeoutMs         int  // /objects requests taking longer are answered with 503, 0 disables the bound
+	AdminTimeoutMs           int  // same for /pipeline and the admin endpoints
+
+	TesterSelfTest        bool // request TesterSelfTestPath at startup and stay unready until the tester answers it
+	TesterSelfTestPath    string
+	TesterSelfTestRetries int // attempts after the first failed one, a second apart
 }
 
 type timer struct {
+	mu     *sync.Mutex
+	wg     *sync.WaitGroup // goroutines awaiting expiration of the timers
+	byID   map[models.ID]*timerEntry
+	paused bool // no timers are armed while paused, so nothing expires
+}
+
+type timerEntry struct {
+	timer    Timer
+	deadline time.Time
+	cancel   chan struct{} // closed when the timer is removed before firing
+}
+
+func (t *timer) remove(id models.ID) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry, ok := t.byID[id]
+	if !ok {
+		return false
+	}
+	entry.timer.Stop()
+	close(entry.cancel)
+	delete(t.byID, id)
+	return true
+}
+
+// pause stops and forgets all timers, returning how many were stopped
+func (t *timer) pause() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.paused = true
+	return t.stopAllLocked()
+}
+
+// stopAll stops and forgets all timers, signalling their goroutines to exit
+func (t *timer) stopAll() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stopAllLocked()
+}
+
+func (t *timer) stopAllLocked() int {
+	n := len(t.byID)
+	for id, entry := range t.byID {
+		entry.timer.Stop()
+		close(entry.cancel)
+		delete(t.byID, id)
+	}
+	return n
+}
+
+// cooldown suppresses repeats of an action for the same id within a window
+type cooldown struct {
+	mu     *sync.Mutex
+	window time.Duration
+	last   map[models.ID]time.Time
+}
+
+// cooldownSweepSize is how many ids cooldown tracks before forgetting the ones out of their window
+const cooldownSweepSize = 1024
+
+func newCooldown(window time.Duration) *cooldown {
+	return &cooldown{mu: new(sync.Mutex), window: window, last: make(map[models.ID]time.Time)}
+}
+
+// allow reports whether the action for id may run at now, recording it if so. A nil cooldown allows everything.
+func (c *cooldown) allow(id models.ID, now time.Time) bool {
+	if c == nil {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if last, ok := c.last[id]; ok && now.Sub(last) < c.window {
+		return false
+	}
+	if len(c.last) >= cooldownSweepSize {
+		for other, last := range c.last {
+			if now.Sub(last) >= c.window {
+				delete(c.last, other)
+			}
+		}
+	}
+	c.last[id] = now
+	return true
+}
+
+type observations struct {
 	mu   *sync.Mutex
-	byID map[int]*time.Timer
+	byID map[models.ID]observation
+}
+
+type observation struct {
+	at     time.Time
+	online bool
+}
+
+// accept records the observation unless a newer one was already accepted for the same id,
+// making concurrent online/offline fetches of one id resolve as last-write-wins.
+// It returns the previously accepted observation, zero if the id wasn't observed before.
+func (o *observations) accept(id models.ID, obs observation) (observation, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	prev := o.byID[id]
+	if obs.at.Before(prev.at) {
+		return prev, false
+	}
+	o.byID[id] = obs
+	return prev, true
+}
+
+// isLatest reports whether the observation at is still the newest of id. Observations are only
+// forgotten once the object was deleted, so a write observed before that is stale too.
+func (o *observations) isLatest(id models.ID, at time.Time) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	latest, ok := o.byID[id]
+	return ok && !at.Before(latest.at)
+}
+
+func (o *observations) forget(id models.ID) {
+	o.mu.Lock()
+	delete(o.byID, id)
+	o.mu.Unlock()
+}
+
+// objectLocks serializes database writes of one object id, so an upsert and a delete
+// of the same id queued at the same time can't overtake each other. Ids are striped
+// over a fixed number of mutexes to keep memory bounded.
+type objectLocks [objectLockStripes]sync.Mutex
+
+const objectLockStripes = 64
+
+// hashID spreads ids evenly over stripes and shards, whatever their format
+func hashID(id models.ID) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(id))
+	return h.Sum32()
+}
+
+func (l *objectLocks) stripe(id models.ID) int {
+	return int(hashID(id) % uint32(len(l)))
+}
+
+func (l *objectLocks) lock(id models.ID) func() {
+	mu := &l[l.stripe(id)]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// lockAll locks the stripes of all ids in ascending order, so concurrent batches can't deadlock
+func (l *objectLocks) lockAll(ids []models.ID) func() {
+	var held [objectLockStripes]bool
+	for _, id := range ids {
+		held[l.stripe(id)] = true
+	}
+	for i := range held {
+		if held[i] {
+			l[i].Lock()
+		}
+	}
+	return func() {
+		for i := range held {
+			if held[i] {
+				l[i].Unlock()
+			}
+		}
+	}
+}
+
+type deleteReason string
+
+const (
+	reasonOffline   deleteReason = "offline"            // tester reported the object offline
+	reasonExpired   deleteReason = "expired-timer"      // object wasn't received again within retention
+	reasonColdStart deleteReason = "cold-start-expired" // stored object was already beyond retention (or offline) at startup
+	reasonExternal  deleteReason = "external"           // delete requested by an external system through NOTIFY
+)
+
+// task is an object travelling through the pipeline
+type task struct {
+	obj        models.Object
+	reason     deleteReason // why the object is deleted, only set for deletes
+	acceptedAt time.Time    // when /callback accepted the id, zero for work not started by a callback
+	deadline   time.Time    // fetching and persisting the object is abandoned after it, zero for no deadline
+	observedAt time.Time    // when the tester reported the state this task persists, zero if it doesn't stem from an observation
+	seq        uint64       // backlog entry while waiting in inputCh, see service.queue
+}
+
+// objectLog returns the logger for lines about one object, tagged with its id as a structured field if enabled
+func (s *service) objectLog(id models.ID) logger.Logger {
+	if !s.cfg.LogObjectID {
+		return s.log
+	}
+	return s.log.With("object_id", id)
+}
+
+// superseded reports whether a newer observation of the object was accepted since this task was queued
+func (s *service) superseded(t task) bool {
+	return !t.observedAt.IsZero() && !s.observations.isLatest(t.obj.ID, t.observedAt)
+}
+
+// forgetDeleted stops tracking the object of a delete, its timer included, unless an observation
+// newer than the delete's was accepted meanwhile and owns the id now. Holding the observations lock
+// keeps such an observation from arming a timer this would then stop.
+func (s *service) forgetDeleted(t task) {
+	s.observations.mu.Lock()
+	defer s.observations.mu.Unlock()
+	if t.observedAt.Before(s.observations.byID[t.obj.ID].at) {
+		return
+	}
+	s.timers.remove(t.obj.ID)
+	delete(s.observations.byID, t.obj.ID)
+}
+
+// context bounds ctx by the task's processing deadline, if it has one
+func (t task) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if t.deadline.IsZero() {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, t.deadline)
 }
 
 type service struct {
-	database   postgres.Postgres
-	log        logger.Logger
-	cfg        Config
-	router     *httprouter.Router
-	httpClient *http.Client
+	database      postgres.Postgres
+	log           logger.Logger
+	metrics       *serviceMetrics
+	cfg           Config
+	router        *httprouter.Router
+	httpClient    *http.Client
+	clock         Clock
+	fetches       *singleflight.Group
+	retries       *retryBudget
+	testerLimiter *rate.Limiter // nil without TesterRPS
+	publisher     events.Publisher
+	receipts      receipts.Sink
 
-	isRunning bool
+	running       int32 // accessed atomically, 1 once Run was called
+	coldStartDone int32 // accessed atomically, 1 once cold start finished (or failed)
+	reconciling   int32 // accessed atomically, 1 while cold start or a resync walks stored objects
+	testerReached int32 // accessed atomically, 1 once the startup self-test passed, or right away when it's disabled
+	started       int32 // accessed atomically, 1 while the pipeline goroutines run, back to 0 on shutdown
+	draining      int32 // accessed atomically, 1 once Drain was called
 
-	inputCh      chan int
+	inputCh      chan task
+	coalesceCh   chan []task
 	expirationCh chan models.Object
-	upsertCh     chan models.Object
-	deleteCh     chan int
+	upsertCh     chan task
+	deleteCh     chan task
+
+	timers       *timer
+	observations *observations
+	locks        *objectLocks
+	backlog      *backlog
+
+	deleteCooldown *cooldown // nil without DeleteCooldownMs
 
-	timers *timer
+	activeWorkers int64 // accessed atomically, goroutines currently fetching, upserting or deleting
+
+	callbackSlots chan struct{}  // bounds callbacks being processed at once, nil for no bound
+	dbSlots       chan struct{}  // bounds database writes in flight, nil for no bound
+	shards        []chan shardOp // per shard queues of writes when WorkerShards is set, nil otherwise
+	ingester      Ingester
+
+	routes     *sync.Once
+	callbackMu *sync.Mutex
+	callback   *callbackTarget // nil until the HTTP ingester started
+	work       *inflight       // goroutines feeding the write channels, stopped first on shutdown
+	writes     *inflight       // goroutines persisting what the write channels carry, and the writes they spawned
+	shardWork  *inflight       // shard workers, nil without WorkerShards
+
+	intakeStopped   chan struct{} // closed once nothing feeds upsertCh and deleteCh anymore, writers then empty them and return
+	dispatchStopped chan struct{} // closed once nothing feeds the shard queues anymore, shards then empty them and return
 }
 
 var (
 	singleton *service
-	once      = new(sync.Once)
-)
+	mu        = new(sync.Mutex)
 
-func Load(db postgres.Postgres, log logger.Logger, cfg Config) *service {
-	once.Do(func() {
-		tr := &http.Transport{
-			MaxIdleConns:    cfg.MaxObjectsPerRequest,
-			MaxConnsPerHost: cfg.MaxObjectsPerRequest,
-		}
-		client := &http.Client{Timeout: time.Duration(cfg.HTTP.TimeoutSec) * time.Second, Transport: tr}
-		singleton = &service{
-			database:     db,
-			log:          log,
-			cfg:          cfg,
-			router:       httprouter.New(),
-			httpClient:   client,
-			inputCh:      make(chan int, cfg.MaxObjectsPerRequest),
-			expirationCh: make(chan models.Object, cfg.MaxObjectsPerRequest),
-			upsertCh:     make(chan models.Object, cfg.MaxObjectsPerRequest),
-			deleteCh:     make(chan int, cfg.MaxObjectsPerRequest),
-			timers: &timer{
-				mu:   new(sync.Mutex),
-				byID: make(map[int]*time.Timer),
-			},
-		}
-	})
+	errAlreadyRunning  = errors.New("service is already running")
+	errNotLoaded       = errors.New("service used before Load succeeded")
+	errMissingDeps     = errors.New("service needs a database and a logger")
+	errShutdownTimeout = errors.New("shutdown grace period exceeded, abandoning the drain")
+)
 
-	return singleton
+func newPublisher(cfg Config) events.Publisher {
+	if cfg.EventsURL == "" {
+		return events.NewNoop()
+	}
+	return events.NewHTTP(cfg.EventsURL, &http.Client{Timeout: time.Duration(cfg.HTTP.TimeoutSec) * time.Second})
 }
 
-func (s *service) Run(ctx context.Context) {
-	if s.isRunning { // preventing multiple runs
+// SetPublisher replaces the publisher configured by EventsURL. Observations read it unsynchronized,
+// so the swap belongs before Run.
+func (s *service) SetPublisher(publisher events.Publisher) {
+	if s == nil {
 		return
 	}
-	s.isRunning = true
+	s.publisher = publisher
+}
+
+// Load builds the service on the first successful call and returns the same instance afterwards.
+// A failed construction is not cached, so a later call can succeed once its cause is fixed.
+func Load(db postgres.Postgres, log logger.Logger, cfg Config) (*service, error) {
+	if db == nil || log == nil {
+		return nil, errMissingDeps
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if singleton != nil {
+		return singleton, nil
+	}
+	s, err := newService(db, log, cfg)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	singleton = s
+	return singleton, nil
+}
+
+// newService builds an instance independent of the one shared through Load
+func newService(db postgres.Postgres, log logger.Logger, cfg Config) (*service, error) {
+	client, err := newHTTPClient(cfg, log)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxObjectsPerRequest > extremeMaxObjectsPerRequest {
+		log.Warn("MAX_OBJECTS_PER_REQUEST=%v is extreme, it sizes the tester connection pool (and the pipeline channels unless CHANNEL_BUFFER_SIZE is set)", cfg.MaxObjectsPerRequest)
+	}
+	buffer := cfg.ChannelBufferSize
+	if buffer <= 0 {
+		buffer = cfg.MaxObjectsPerRequest
+	}
+	s := &service{
+		database:     db,
+		log:          log,
+		metrics:      newServiceMetrics(metrics.New(log)),
+		cfg:          cfg,
+		router:       httprouter.New(),
+		httpClient:   client,
+		clock:        realClock{},
+		retries:      newRetryBudget(cfg.RetryBudget, cfg.RetryBudgetRefillPerSec, realClock{}),
+		fetches:      new(singleflight.Group),
+		publisher:    newPublisher(cfg),
+		receipts:     newReceiptSink(cfg),
+		inputCh:      make(chan task, buffer),
+		coalesceCh:   make(chan []task, buffer),
+		expirationCh: make(chan models.Object, buffer),
+		upsertCh:     make(chan task, buffer),
+		deleteCh:     make(chan task, buffer),
+		timers: &timer{
+			mu:   new(sync.Mutex),
+			wg:   new(sync.WaitGroup),
+			byID: make(map[models.ID]*timerEntry),
+		},
+		observations: &observations{
+			mu:   new(sync.Mutex),
+			byID: make(map[models.ID]observation),
+		},
+		locks: new(objectLocks),
+		backlog: &backlog{
+			mu:     new(sync.Mutex),
+			queued: make(map[uint64]time.Time),
+		},
+	}
+	if !cfg.HTTP.TesterSelfTest {
+		s.testerReached = 1
+	}
+	if cfg.MaxConcurrentCallbacks > 0 {
+		s.callbackSlots = make(chan struct{}, cfg.MaxConcurrentCallbacks)
+	}
+	s.ingester = httpIngester{s: s}
+	s.routes = new(sync.Once)
+	s.callbackMu = new(sync.Mutex)
+	s.work = new(inflight)
+	s.writes = new(inflight)
+	s.intakeStopped = make(chan struct{})
+	s.dispatchStopped = make(chan struct{})
+	if cfg.WorkerShards > 0 {
+		s.shardWork = new(inflight)
+		s.shards = make([]chan shardOp, cfg.WorkerShards)
+		for i := range s.shards {
+			s.shards[i] = make(chan shardOp, buffer)
+		}
+	}
+	if cfg.HTTP.TesterRPS > 0 {
+		burst := cfg.HTTP.TesterBurst
+		if burst < 1 {
+			burst = 1
+		}
+		s.testerLimiter = rate.NewLimiter(rate.Limit(cfg.HTTP.TesterRPS), burst)
+	}
+	if cfg.DeleteCooldownMs > 0 {
+		s.deleteCooldown = newCooldown(time.Duration(cfg.DeleteCooldownMs) * time.Millisecond)
+	}
+	if cfg.DBMaxConcurrentWrites > 0 {
+		s.dbSlots = make(chan struct{}, cfg.DBMaxConcurrentWrites)
+	}
+	s.metrics.registerServiceGauges(s)
+	return s, nil
+}
+
+func (s *service) Run(ctx context.Context) error {
+	if s == nil {
+		return errNotLoaded
+	}
+	if !atomic.CompareAndSwapInt32(&s.running, 0, 1) { // preventing multiple runs
+		s.log.Warn("service is already running, ignoring repeated Run call")
+		return errAlreadyRunning
+	}
+
+	s.registerRoutes(ctx)
 
-	go s.coldStart(ctx)               // get all existing objects from database and handle their expirations if no object with such id came
-	go s.handleCallbackRoute(ctx)     // listening requests with object ids from tester program and passing ids to input channel
-	go s.retrieveObjects(ctx)         // reading input channel, retrieving objects' statuses and passing them to the channel depending on the object's status (online -> upsert && expire channels, offline -> delete channel)
-	go s.handleUpsert(ctx)            // reading upsert channel, upserting incoming online objects
-	go s.handleObjectsExpiration(ctx) // handle expire time for objects, that weren't received repeatedly for the predefined time
-	go s.handleDelete(ctx)            // delete expired objects
+	// writes outlive ctx, so what the intake already accepted is persisted on shutdown
+	writeCtx, cancelWrites := context.WithCancel(context.Background())
+	defer cancelWrites()
+
+	if s.cfg.HTTP.TesterSelfTest {
+		go s.selfTest(ctx) // failing fast on a misconfigured tester address instead of erroring on every callback
+	}
+	if s.cfg.SkipColdStart {
+		s.log.Info("cold start disabled, not arming timers for stored objects")
+		atomic.StoreInt32(&s.coldStartDone, 1)
+	} else {
+		s.work.spawn(func() { s.coldStart(ctx) }) // get all existing objects from database and handle their expirations if no object with such id came
+	}
+	s.work.spawn(func() { s.ingest(ctx) })          // listening for object ids from tester program (on /callback unless replaced) and passing ids to input channel
+	s.work.spawn(func() { s.retrieveObjects(ctx) }) // reading input channel, retrieving objects' statuses and passing them to the channel depending on the object's status (online -> upsert && expire channels, offline -> delete channel)
+	for i := range s.shards {
+		shard := s.shards[i]
+		s.shardWork.spawn(func() { s.runShard(writeCtx, shard) }) // persisting the writes of one id partition in order
+	}
+	s.writes.spawn(func() { s.handleUpsert(writeCtx) })     // reading upsert channel, upserting incoming online objects
+	s.work.spawn(func() { s.handleObjectsExpiration(ctx) }) // handle expire time for objects, that weren't received repeatedly for the predefined time
+	s.writes.spawn(func() { s.handleDelete(writeCtx) })     // delete expired objects
+	if s.cfg.DeleteNotifyChannel != "" {
+		s.work.spawn(func() { s.listenExternalDeletes(ctx) }) // removing objects deleted by external systems through postgres NOTIFY
+	}
+	if s.cfg.BackfillSource != "" {
+		s.work.spawn(func() { s.backfill(ctx) }) // re-fetching a bootstrap set of ids from the tester
+	}
+	if s.cfg.MetricsLogIntervalSec > 0 {
+		go s.logMetrics(ctx) // baseline observability from logs alone, where nothing scrapes /metrics
+	}
+	if s.cfg.CallbackCoalesceMs > 0 {
+		s.work.spawn(func() { s.coalesceCallbacks(ctx) }) // merging ids of chatty callbacks into deduplicated batches before passing them to input channel
+	}
+	atomic.StoreInt32(&s.started, 1)
 	go func() { _ = http.ListenAndServe(fmt.Sprintf(":%v", s.cfg.HTTP.ListenPort), s.router) }()
 
+	<-ctx.Done()
+	atomic.StoreInt32(&s.started, 0)
+	s.work.stop() // callbacks are refused from here on
+	drained := make(chan struct{})
+	go func() {
+		s.drain()
+		close(drained)
+	}()
+	if s.cfg.ShutdownTimeoutSec > 0 {
+		select {
+		case <-drained:
+		case <-time.After(time.Duration(s.cfg.ShutdownTimeoutSec) * time.Second):
+			// abandoning writes still in flight, whatever is left in the channels is lost
+			cancelWrites()
+			return errShutdownTimeout // channels stay open, stuck senders would panic on closed ones
+		}
+	} else {
+		<-drained
+	}
+	s.log.Debug("closing all channels")
+	s.close()
+	return nil
+}
+
+// drain stops the pipeline front to back once the Run context is done: intake first, so nothing
+// arms timers or queues writes behind it, then the timers, then the writers, which persist
+// everything still queued before returning
+func (s *service) drain() {
+	s.log.Debug("waiting for in-flight fetches and the expiration loop to finish")
+	s.work.wait()
+	stopped := s.timers.stopAll()
+	s.log.Debug("stopped %v timers, waiting for their goroutines to exit", stopped)
+	s.timers.wg.Wait()
+	s.log.Debug("flushing queued writes")
+	close(s.intakeStopped)
+	s.writes.wait()
+	close(s.dispatchStopped)
+	if s.shardWork != nil {
+		s.shardWork.wait()
+	}
+}
+
+// queued empties ch without blocking. Writers call it once intake stopped, when nothing sends to ch anymore.
+func queued(ch <-chan task) []task {
+	var tasks []task
 	for {
 		select {
-		case <-ctx.Done():
-			s.log.Debug("closing all channels")
-			s.close()
+		case t := <-ch:
+			tasks = append(tasks, t)
+		default:
+			return tasks
 		}
 	}
 }
 
+// registerRoutes registers every route once per instance, before the router serves anything,
+// since httprouter panics on duplicate routes and must not be modified while serving
+func (s *service) registerRoutes(ctx context.Context) {
+	s.routes.Do(func() {
+		s.handleFallbackRoutes(ctx) // JSON responses for unknown paths and wrong methods
+		s.handleHealthRoutes(ctx)   // liveness and readiness probes for load balancers and kubernetes
+		s.handleMetricsRoute(ctx)   // exposing collected metrics for prometheus
+		s.handlePipelineRoute(ctx)  // channel depths, lag and active workers in one payload
+		s.handleObjectsRoute(ctx)   // listing objects modified since a timestamp for downstream syncs
+		s.handleAdminRoutes(ctx)    // pausing and resuming expiration timers for maintenance windows, resyncs, debug dumps if enabled
+		if _, ok := s.ingester.(httpIngester); ok {
+			s.router.POST("/callback", s.serveCallback) // answered with 503 until the ingester started
+		}
+	})
+}
+
 func (s *service) close() {
 	close(s.expirationCh)
 	close(s.inputCh)
@@ -111,162 +644,1136 @@ func (s *service) close() {
 	close(s.upsertCh)
 }
 
+// ColdStartDone reports whether stored objects were handed to the pipeline yet
+func (s *service) ColdStartDone() bool {
+	if s == nil {
+		return false
+	}
+	return atomic.LoadInt32(&s.coldStartDone) == 1
+}
+
+// Drain refuses further callbacks with 503 and fails readiness, while ids already queued keep being processed
+// until Run's context is cancelled. It gives load balancers time to stop routing here before the shutdown.
+func (s *service) Drain() {
+	if s == nil {
+		return
+	}
+	atomic.StoreInt32(&s.draining, 1)
+}
+
+func (s *service) Draining() bool {
+	if s == nil {
+		return false
+	}
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// Ready reports whether cold start completed and the tester was reached by the startup self-test, if enabled
+func (s *service) Ready() bool {
+	return s.ColdStartDone() && atomic.LoadInt32(&s.testerReached) == 1
+}
+
 func (s *service) coldStart(ctx context.Context) {
-	objs, err := s.database.GetAll(ctx)
-	if err != nil {
-		s.log.Error(err)
+	defer atomic.StoreInt32(&s.coldStartDone, 1)
+	if !s.beginReconcile() { // only a resync requested before Run got here could hold it
+		s.log.Warn("resync already running, skipping cold start")
 		return
 	}
+	defer s.endReconcile()
+	s.reconcileStored(ctx)
+}
+
+// beginReconcile claims the right to walk stored objects, so cold start and resyncs never arm timers
+// for the same objects concurrently. It reports false when another one is still running.
+func (s *service) beginReconcile() bool {
+	return atomic.CompareAndSwapInt32(&s.reconciling, 0, 1)
+}
+
+func (s *service) endReconcile() {
+	atomic.StoreInt32(&s.reconciling, 0)
+}
+
+// reconcileStored hands every stored object to the pipeline, deleting the ones already expired
+// and tracking expiration of the rest
+func (s *service) reconcileStored(ctx context.Context) {
+	workers := s.cfg.ColdStartWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	var (
+		wg   sync.WaitGroup
+		jobs = make(chan models.Object)
+	)
+	for w := 0; w < workers; w++ { // several feeders, so a slow consumer of one channel doesn't serialize the whole cold start
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for obj := range jobs {
+				s.coldStartObject(ctx, obj)
+			}
+		}()
+	}
+	if err := s.loadStored(ctx, jobs); err != nil {
+		s.log.Error(err)
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// loadStored passes every stored object to jobs, reading them page by page
+// with at most ColdStartMaxQueries queries in flight when paging is configured.
+// Pages are id ranges fixed up front rather than offsets, so objects expired and deleted
+// by earlier pages don't shift later ones past rows nobody read.
+func (s *service) loadStored(ctx context.Context, jobs chan<- models.Object) error {
+	if s.cfg.ColdStartPageSize <= 0 {
+		var objs []models.Object
+		err := s.retryColdStart(ctx, "reading stored objects", func() (err error) {
+			objs, err = s.database.GetAll(ctx)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		s.feedColdStart(ctx, objs, jobs)
+		return nil
+	}
+
+	var bounds []models.ID
+	err := s.retryColdStart(ctx, "splitting stored objects into pages", func() (err error) {
+		bounds, err = s.database.GetPageBounds(ctx, s.cfg.ColdStartPageSize)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	maxQueries := s.cfg.ColdStartMaxQueries
+	if maxQueries < 1 {
+		maxQueries = 1
+	}
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		sem      = make(chan struct{}, maxQueries)
+	)
+pages:
+	for i := range bounds {
+		from, to := bounds[i], models.ID("")
+		if i+1 < len(bounds) {
+			to = bounds[i+1]
+		}
+		select {
+		case <-ctx.Done():
+			break pages
+		case sem <- struct{}{}:
+		}
+		wg.Add(1)
+		go func(from, to models.ID) {
+			defer wg.Done()
+			var objs []models.Object
+			err := s.retryColdStart(ctx, "reading a page of stored objects", func() (err error) {
+				objs, err = s.database.GetRange(ctx, from, to)
+				return err
+			})
+			<-sem // the slot only bounds queries, feeding the page may block on the pipeline for a while
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+				return
+			}
+			s.feedColdStart(ctx, objs, jobs)
+		}(from, to)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// retryColdStart calls query until it succeeds, ColdStartRetries repeated attempts failed or ctx is done,
+// so a brief database hiccup at startup doesn't skip reconciliation until the next restart
+func (s *service) retryColdStart(ctx context.Context, what string, query func() error) error {
+	backoff := time.Duration(s.cfg.ColdStartBackoffMs) * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := query()
+		if err == nil || attempt >= s.cfg.ColdStartRetries || ctx.Err() != nil {
+			return err
+		}
+		s.log.Warn("%s failed, retrying in %v: %v", what, backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (s *service) feedColdStart(ctx context.Context, objs []models.Object, jobs chan<- models.Object) {
 	for i := range objs {
-		if objs[i].LastSeenAt != nil && (time.Now().UTC().Sub(*objs[i].LastSeenAt) > time.Second*time.Duration(s.cfg.RetentionPolicySec)) {
-			s.deleteCh <- objs[i].ID
-		} else {
-			s.expirationCh <- objs[i]
+		select {
+		case <-ctx.Done():
+			return
+		case jobs <- objs[i]:
+		}
+		if s.cfg.ColdStartBatchSize > 0 && (i+1)%s.cfg.ColdStartBatchSize == 0 {
+			runtime.Gosched() // yield between batches, so a huge table doesn't monopolize the scheduler
+		}
+	}
+}
+
+func (s *service) coldStartObject(ctx context.Context, obj models.Object) {
+	now := s.clock.Now().UTC()
+	s.clampFutureLastSeen(&obj, now)
+	if !obj.Online && s.cfg.UpsertOffline {
+		s.log.Debug("keeping offline object id=%v, last_seen_at=%v", obj.ID, formatTime(obj.LastSeenAt))
+		if obj.LastSeenAt != nil {
+			s.observations.accept(obj.ID, observation{at: *obj.LastSeenAt, online: false})
+		}
+		return
+	}
+	if !obj.Online || (obj.LastSeenAt != nil && now.Sub(*obj.LastSeenAt) > s.retention()) { // offline objects never get timers, same as at runtime
+		s.log.Info("deleting object id=%v, reason=%s, online=%v, last_seen_at=%v, retention=%v", obj.ID, reasonColdStart, obj.Online, formatTime(obj.LastSeenAt), s.retention())
+		select {
+		case <-ctx.Done():
+		case s.deleteCh <- task{obj: obj, reason: reasonColdStart}:
 		}
+		return
+	}
+	seenAt := now // the timer of an object never seen counts from now, and so must its expiration delete
+	if obj.LastSeenAt != nil {
+		seenAt = *obj.LastSeenAt
+	}
+	s.observations.accept(obj.ID, observation{at: seenAt, online: true}) // stored objects are known online, so seeing them again isn't a transition
+	select {
+	case <-ctx.Done():
+	case s.expirationCh <- obj:
 	}
 }
 
 func (s *service) handleDelete(ctx context.Context) {
+	if s.shards != nil {
+		s.dispatchToShards(ctx, s.deleteCh, false)
+		return
+	}
+	if s.cfg.DeleteBatchSize > 1 {
+		s.handleDeferredDelete(ctx)
+		return
+	}
+	spawnDelete := func(t task) bool {
+		release, ok := s.acquireDBSlot(ctx)
+		if !ok {
+			return false
+		}
+		s.writes.spawn(func() {
+			defer release()
+			defer s.locks.lock(t.obj.ID)()
+			s.deleteObject(ctx, t)
+		})
+		return true
+	}
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case id := <-s.deleteCh:
-			go func(ctx context.Context, id int) {
-				err := s.database.DeleteObjectByID(ctx, id)
-				if err != nil {
-					s.log.Error(err)
-				} else {
-					s.log.Debug("deleted object with id %v", id)
+		case <-s.intakeStopped:
+			for _, t := range queued(s.deleteCh) {
+				if !spawnDelete(t) {
+					return
 				}
-			}(ctx, id)
+			}
+			return
+		case t := <-s.deleteCh:
+			if !spawnDelete(t) {
+				return
+			}
+		}
+	}
+}
+
+// deleteObject deletes the object of t unless a newer observation superseded it.
+// Callers serialize it with other writes of the same id.
+func (s *service) deleteObject(ctx context.Context, t task) {
+	defer s.busy()()
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+	log := s.objectLog(t.obj.ID)
+	if s.superseded(t) {
+		log.Debug("skipping delete of id=%v, superseded by a newer observation", t.obj.ID)
+		return
+	}
+	s.countDeleteSource(t)
+	err := s.dbCall(ctx, "delete", func(ctx context.Context) error {
+		return s.database.DeleteObjectByID(ctx, t.obj.ID)
+	})
+	switch {
+	case err == postgres.ErrObjectNotFound:
+		log.Debug("object with id %v was already absent, nothing deleted (reason=%s)", t.obj.ID, t.reason)
+		s.forgetDeleted(t)
+		s.metrics.deletes.WithLabelValues(deleteAbsent).Inc()
+		s.observeLatency(t)
+	case err != nil:
+		log.Error(err)
+	default:
+		log.Debug("deleted object with id %v (reason=%s)", t.obj.ID, t.reason)
+		s.forgetDeleted(t)
+		s.metrics.deletes.WithLabelValues(deleteDeleted).Inc()
+		s.observeLatency(t)
+		go s.emitReceipt(ctx, t, s.clock.Now().UTC())
+	}
+}
+
+// handleDeferredDelete accumulates deletes and flushes them in one statement
+// once DeleteBatchSize is reached or DeleteFlushMs passed since the first pending one.
+// Whatever is pending on shutdown is still deleted.
+func (s *service) handleDeferredDelete(ctx context.Context) {
+	var (
+		batch []task
+		flush <-chan time.Time
+	)
+	flushBatch := func() {
+		release, ok := s.acquireDBSlot(ctx)
+		if !ok {
+			return
+		}
+		pending := batch
+		s.writes.spawn(func() {
+			defer release()
+			s.deleteBatch(ctx, pending)
+		})
+		batch = nil
+		flush = nil
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.intakeStopped:
+			batch = append(batch, queued(s.deleteCh)...)
+			if len(batch) > 0 {
+				s.log.Info("flushing %v pending deletes before shutdown", len(batch))
+				s.deleteBatch(ctx, batch)
+			}
+			return
+		case t := <-s.deleteCh:
+			batch = append(batch, t)
+			if len(batch) >= s.cfg.DeleteBatchSize {
+				flushBatch()
+			} else if flush == nil {
+				flush = s.after(time.Duration(s.cfg.DeleteFlushMs) * time.Millisecond)
+			}
+		case <-flush:
+			flushBatch()
 		}
 	}
 }
 
+func (s *service) deleteBatch(ctx context.Context, batch []task) {
+	defer s.busy()()
+	ids := make([]models.ID, 0, len(batch))
+	for i := range batch {
+		ids = append(ids, batch[i].obj.ID)
+	}
+	defer s.locks.lockAll(ids)()
+
+	ids = ids[:0]
+	kept := make([]task, 0, len(batch))
+	for i := range batch {
+		if s.superseded(batch[i]) {
+			s.log.Debug("skipping delete of id=%v, superseded by a newer observation", batch[i].obj.ID)
+			continue
+		}
+		ids = append(ids, batch[i].obj.ID)
+		kept = append(kept, batch[i])
+		s.countDeleteSource(batch[i])
+	}
+	if len(ids) == 0 {
+		return
+	}
+	var deleted int64
+	err := s.dbCall(ctx, "batch delete", func(ctx context.Context) (err error) {
+		deleted, err = s.database.DeleteObjectsByIDs(ctx, ids)
+		return err
+	})
+	if err != nil {
+		s.log.Error(err)
+		return
+	}
+	s.log.Debug("deleted %v of %v objects in batch %v", deleted, len(ids), ids)
+	for i := range kept {
+		s.forgetDeleted(kept[i])
+	}
+	s.metrics.deletes.WithLabelValues(deleteDeleted).Add(float64(deleted))
+	s.metrics.deletes.WithLabelValues(deleteAbsent).Add(float64(int64(len(ids)) - deleted))
+	deletedAt := s.clock.Now().UTC()
+	for i := range kept {
+		s.observeLatency(kept[i])
+	}
+	for i := range kept { // the batch statement doesn't tell which ids were already absent, so all of them get a receipt
+		go s.emitReceipt(ctx, kept[i], deletedAt)
+	}
+}
+
 func (s *service) handleObjectsExpiration(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case obj := <-s.expirationCh:
+			log := s.objectLog(obj.ID)
+			if !obj.Online {
+				log.Debug("not tracking expiration of offline id %v", obj.ID)
+				continue
+			}
 			s.timers.mu.Lock()
-			if timer, ok := s.timers.byID[obj.ID]; !ok {
-				now := time.Now().UTC()
-				if obj.LastSeenAt != nil && now.Sub(*obj.LastSeenAt) < time.Second*time.Duration(s.cfg.RetentionPolicySec) {
-					s.timers.byID[obj.ID] = time.NewTimer(time.Second*time.Duration(s.cfg.RetentionPolicySec) - now.Sub(*obj.LastSeenAt))
-				} else {
-					s.timers.byID[obj.ID] = time.NewTimer(time.Second * time.Duration(s.cfg.RetentionPolicySec))
+			if s.timers.paused {
+				s.timers.mu.Unlock()
+				log.Debug("timers are paused, not tracking expiration of id %v", obj.ID)
+				continue
+			}
+			now := s.clock.Now().UTC()
+			s.clampFutureLastSeen(&obj, now)
+			d := s.expiresIn(obj, now)
+			if entry, ok := s.timers.byID[obj.ID]; !ok {
+				entry = &timerEntry{
+					timer:    s.clock.NewTimer(d),
+					deadline: now.Add(d),
+					cancel:   make(chan struct{}),
 				}
-				s.log.Debug("set new timer for id %v", obj.ID)
+				s.timers.byID[obj.ID] = entry
+				log.Debug("set new timer for id %v", obj.ID)
+				s.metrics.timersCreated.Inc()
+				s.timers.wg.Add(1)
 				s.timers.mu.Unlock()
-				go func(id int) {
-					<-s.timers.byID[id].C
-					s.log.Debug("expired object with id %v, sending to delete chan", id)
-					s.timers.mu.Lock()
-					delete(s.timers.byID, id)
-					s.deleteCh <- id
-					s.timers.mu.Unlock()
-				}(obj.ID)
-			} else {
-				if !timer.Stop() {
-					<-timer.C
+				go s.awaitExpiration(ctx, obj.ID, entry)
+			} else if deadline := now.Add(d); deadline.After(entry.deadline) { // refresh timer if id was received before expire
+				if !entry.timer.Stop() {
+					select { // drain a fire the waiting goroutine hasn't consumed yet
+					case <-entry.timer.C():
+					default:
+					}
 				}
-				s.log.Debug("received id %v before expiration, refreshing timer", obj.ID)
-				timer.Reset(time.Second * time.Duration(s.cfg.RetentionPolicySec)) // refresh timer if id was received before expire
+				log.Debug("received id %v before expiration, refreshing timer", obj.ID)
+				s.metrics.timersRefreshed.Inc()
+				entry.timer.Reset(d)
+				entry.deadline = deadline
+				s.timers.mu.Unlock()
+			} else { // a resync or an older sighting, the armed deadline already covers it
+				log.Debug("id %v already expires at %v, keeping its timer", obj.ID, entry.deadline.UTC())
 				s.timers.mu.Unlock()
 			}
 		}
 	}
 }
 
-func (s *service) retrieveObjects(ctx context.Context) {
+// awaitExpiration sends the delete of id once its timer fires. Run waits for every awaitExpiration
+// to return before closing deleteCh, so the send can't hit a closed channel.
+func (s *service) awaitExpiration(ctx context.Context, id models.ID, entry *timerEntry) {
+	log := s.objectLog(id)
+	defer s.timers.wg.Done()
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case id := <-s.inputCh:
-			go func(ctx context.Context, id int) {
-				req, err := http.NewRequestWithContext(
-					ctx,
-					http.MethodGet,
-					fmt.Sprintf("http://%s:%s/objects/%v", s.cfg.HTTP.TesterHost, s.cfg.HTTP.TesterPort, id),
-					nil,
-				)
-				if err != nil {
-					s.log.Error(err)
-					return
-				}
-				s.log.Debug("requesting info by id=%v", id)
-				resp, err := s.httpClient.Do(req)
-				if err != nil {
-					s.log.Error(err)
-					return
-				}
-				var (
-					info models.Object
-					dec  = json.NewDecoder(resp.Body)
-				)
-				err = dec.Decode(&info)
-				if errBodyClose := resp.Body.Close(); errBodyClose != nil {
-					s.log.Error(err)
-				}
-				if err != nil {
-					s.log.Error(err)
+		case <-entry.cancel:
+			return
+		case <-entry.timer.C():
+		}
+		if ctx.Err() != nil { // fired during shutdown, select above may pick either ready case
+			return
+		}
+		s.timers.mu.Lock()
+		if s.timers.byID[id] != entry { // removed while firing
+			s.timers.mu.Unlock()
+			return
+		}
+		if s.clock.Now().Before(entry.deadline) { // refreshed while firing, wait for the new deadline
+			s.timers.mu.Unlock()
+			continue
+		}
+		log.Info("deleting object id=%v, reason=%s, expired_at=%v", id, reasonExpired, entry.deadline.UTC())
+		delete(s.timers.byID, id)
+		s.timers.mu.Unlock() // a slow delete consumer must not block every other timer operation
+		select {             // stamped with the deadline, so an observation accepted after the timer fired supersedes the delete
+		case <-ctx.Done():
+		case s.deleteCh <- task{obj: models.Object{ID: id}, reason: reasonExpired, observedAt: entry.deadline}:
+		}
+		return
+	}
+}
+
+// expiresIn returns how long obj has left at now, counting retention from its last_seen_at
+func (s *service) expiresIn(obj models.Object, now time.Time) time.Duration {
+	retention := s.retention()
+	if obj.LastSeenAt != nil && now.Sub(*obj.LastSeenAt) < retention {
+		return retention - now.Sub(*obj.LastSeenAt)
+	}
+	return retention
+}
+
+// clampFutureLastSeen treats a last_seen_at in the future (clock skew or bad data) as seen now,
+// otherwise the negative age would arm an overly long timer pinning the object
+func (s *service) clampFutureLastSeen(obj *models.Object, now time.Time) {
+	if obj.LastSeenAt != nil && obj.LastSeenAt.After(now) {
+		s.log.Warn("id %v has last_seen_at %v in the future, treating it as seen now", obj.ID, *obj.LastSeenAt)
+		obj.LastSeenAt = &now
+	}
+}
+
+// retention returns the configured retention policy clamped to the configured floor and ceiling
+func (s *service) retention() time.Duration {
+	sec := s.cfg.RetentionPolicySec
+	if s.cfg.MinRetentionSec > 0 && sec < s.cfg.MinRetentionSec {
+		sec = s.cfg.MinRetentionSec
+	}
+	if s.cfg.MaxRetentionSec > 0 && sec > s.cfg.MaxRetentionSec {
+		sec = s.cfg.MaxRetentionSec
+	}
+	return time.Second * time.Duration(sec)
+}
+
+// retrieveObjects looks up ids from inputCh on a fixed pool of MaxConcurrentFetches workers,
+// so a burst of callbacks queues in the channel instead of opening a request per id at once
+func (s *service) retrieveObjects(ctx context.Context) {
+	workers := s.cfg.MaxConcurrentFetches
+	if workers <= 0 {
+		workers = s.cfg.MaxObjectsPerRequest
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
 					return
+				case t, ok := <-s.inputCh:
+					if !ok {
+						return
+					}
+					s.backlog.done(t.seq)
+					if s.cfg.ProcessingTimeoutSec > 0 {
+						t.deadline = s.clock.Now().Add(time.Duration(s.cfg.ProcessingTimeoutSec) * time.Second)
+					}
+					s.retrieveObject(ctx, t)
 				}
-				s.log.Debug("got info for id=%v, online=%v", info.ID, info.Online)
-				if info.Online {
-					now := time.Now().UTC()
-					info.LastSeenAt = &now
-				}
+			}
+		}()
+	}
+	wg.Wait()
+}
 
-				switch info.Online {
-				case true:
-					s.upsertCh <- info     // update or insert online objects
-					s.expirationCh <- info // track expiration time
-				case false:
-					s.deleteCh <- info.ID // delete objects with offline status
-				}
-			}(ctx, id)
+// retrieveObject fetches the state of one id from the tester and routes it to the upsert or delete channel
+func (s *service) retrieveObject(ctx context.Context, t task) {
+	defer s.busy()()
+	fetchCtx, cancel := t.context(ctx)
+	defer cancel()
+	id := t.obj.ID
+	log := s.objectLog(id)
+	info, err := s.fetchCoalesced(fetchCtx, id)
+	if err != nil {
+		log.Error(err)
+		s.metrics.observations.WithLabelValues(statusError).Inc()
+		return
+	}
+	if !info.Online && s.cfg.ConfirmOffline {
+		if info, err = s.confirmOffline(fetchCtx, id); err != nil {
+			log.Error(err)
+			s.metrics.observations.WithLabelValues(statusError).Inc()
+			return
+		}
+	}
+	log.Debug("got info for id=%v, online=%v", info.ID, info.Online)
+	if !s.cfg.StoreLabels {
+		info.Label = nil
+	}
+	if info.Online {
+		s.metrics.observations.WithLabelValues(statusOnline).Inc()
+	} else {
+		s.metrics.observations.WithLabelValues(statusOffline).Inc()
+	}
+	observedAt := s.clock.Now().UTC()
+	prev, ok := s.observations.accept(info.ID, observation{at: observedAt, online: info.Online})
+	if !ok {
+		log.Debug("dropping stale observation for id=%v, a newer one was already accepted", info.ID)
+		return
+	}
+	if s.cfg.TrackTransitions && !prev.at.IsZero() && prev.online != info.Online {
+		from, to := observationState(prev.online), observationState(info.Online)
+		log.Info("object id=%v went %s -> %s, previously observed at %v", info.ID, from, to, prev.at)
+		s.metrics.transitions.WithLabelValues(from, to).Inc()
+	}
+	switch {
+	case info.Online && !prev.online:
+		go s.publish(ctx, events.Event{ObjectID: info.ID, Kind: events.KindSeen, At: observedAt})
+	case !info.Online && prev.online:
+		go s.publish(ctx, events.Event{ObjectID: info.ID, Kind: events.KindOffline, At: observedAt})
+	}
+	if info.Online || s.cfg.UpsertOffline {
+		info.LastSeenAt = &observedAt
+	}
+
+	switch {
+	case info.Online:
+		s.send(ctx, s.upsertCh, task{obj: info, acceptedAt: t.acceptedAt, deadline: t.deadline, observedAt: observedAt}) // update or insert online objects
+		select {
+		case <-ctx.Done():
+		case s.expirationCh <- info: // track expiration time
 		}
+	case s.cfg.UpsertOffline:
+		s.timers.remove(info.ID)                                                                                         // the row stays, so its retention must not delete it later
+		s.send(ctx, s.upsertCh, task{obj: info, acceptedAt: t.acceptedAt, deadline: t.deadline, observedAt: observedAt}) // keep offline objects with online=false
+	case !s.deleteCooldown.allow(info.ID, observedAt):
+		log.Debug("skipping delete of id=%v, another one was sent within the last %vms", info.ID, s.cfg.DeleteCooldownMs)
+	default:
+		log.Info("deleting object id=%v, reason=%s, observed_at=%v", info.ID, reasonOffline, observedAt)
+		s.send(ctx, s.deleteCh, task{obj: info, reason: reasonOffline, acceptedAt: t.acceptedAt, deadline: t.deadline, observedAt: observedAt}) // delete objects with offline status
 	}
 }
 
+// send passes t on to ch unless the service shuts down first, so fetch workers never block past shutdown
+func (s *service) send(ctx context.Context, ch chan<- task, t task) {
+	select {
+	case <-ctx.Done():
+	case ch <- t:
+	}
+}
+
+func (s *service) publish(ctx context.Context, event events.Event) {
+	if err := s.publisher.Publish(ctx, event); err != nil {
+		s.log.Error(err)
+	}
+}
+
+// confirmOffline re-fetches an object reported offline after a short delay,
+// so a transient offline blip from the tester doesn't delete it
+func (s *service) confirmOffline(ctx context.Context, id models.ID) (models.Object, error) {
+	select {
+	case <-ctx.Done():
+		return models.Object{}, ctx.Err()
+	case <-s.after(time.Duration(s.cfg.ConfirmOfflineDelayMs) * time.Millisecond):
+	}
+	s.log.Debug("id=%v reported offline, confirming before delete", id)
+	return s.fetchObject(ctx, id)
+}
+
 func (s *service) handleUpsert(ctx context.Context) {
+	if s.shards != nil {
+		s.dispatchToShards(ctx, s.upsertCh, true)
+		return
+	}
+	if s.cfg.UpsertBatchSize > 1 && !s.cfg.RecordObservations { // events are recorded per object, in the upsert's own transaction
+		s.handleBatchedUpsert(ctx)
+		return
+	}
+	spawnUpsert := func(t task) bool {
+		release, ok := s.acquireDBSlot(ctx)
+		if !ok {
+			return false
+		}
+		s.writes.spawn(func() {
+			defer release()
+			defer s.locks.lock(t.obj.ID)()
+			s.upsertObject(ctx, t)
+		})
+		return true
+	}
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case obj := <-s.upsertCh:
-			go func(ctx context.Context, obj models.Object) {
-				s.log.Debug("upserting object: id=%v, online=%v", obj.ID, obj.Online)
-				if err := s.database.UpsertObject(ctx, obj); err != nil {
-					s.log.Error(err)
+		case <-s.intakeStopped:
+			for _, t := range queued(s.upsertCh) {
+				if !spawnUpsert(t) {
+					return
 				}
-			}(ctx, obj)
+			}
+			return
+		case t := <-s.upsertCh:
+			if !spawnUpsert(t) {
+				return
+			}
 		}
 	}
 }
 
-func (s *service) handleCallbackRoute(_ context.Context) {
-	s.router.POST("/callback", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-		dec := json.NewDecoder(r.Body)
-		var input models.ObjectsInput
-		err := dec.Decode(&input)
-		if errBodyClose := r.Body.Close(); errBodyClose != nil {
-			s.log.Error(errBodyClose)
+// handleBatchedUpsert accumulates upserts and writes them in one batch once UpsertBatchSize
+// is reached or UpsertFlushMs passed since the first pending one. Whatever is pending on
+// shutdown is still written.
+func (s *service) handleBatchedUpsert(ctx context.Context) {
+	var (
+		batch []task
+		flush <-chan time.Time
+	)
+	flushBatch := func() {
+		release, ok := s.acquireDBSlot(ctx)
+		if !ok {
+			return
 		}
-		if err != nil {
+		pending := batch
+		s.writes.spawn(func() {
+			defer release()
+			s.upsertBatch(ctx, pending)
+		})
+		batch = nil
+		flush = nil
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.intakeStopped:
+			batch = append(batch, queued(s.upsertCh)...)
+			if len(batch) > 0 {
+				s.log.Info("flushing %v pending upserts before shutdown", len(batch))
+				s.upsertBatch(ctx, batch)
+			}
+			return
+		case t := <-s.upsertCh:
+			batch = append(batch, t)
+			if len(batch) >= s.cfg.UpsertBatchSize {
+				flushBatch()
+			} else if flush == nil {
+				flush = s.after(time.Duration(s.cfg.UpsertFlushMs) * time.Millisecond)
+			}
+		case <-flush:
+			flushBatch()
+		}
+	}
+}
+
+func (s *service) upsertBatch(ctx context.Context, batch []task) {
+	defer s.busy()()
+	ids := make([]models.ID, 0, len(batch))
+	for i := range batch {
+		ids = append(ids, batch[i].obj.ID)
+	}
+	defer s.locks.lockAll(ids)()
+
+	objs := make([]models.Object, 0, len(batch))
+	kept := make([]task, 0, len(batch))
+	for i := range batch {
+		if s.superseded(batch[i]) {
+			s.log.Debug("skipping upsert of id=%v, superseded by a newer observation", batch[i].obj.ID)
+			continue
+		}
+		objs = append(objs, batch[i].obj)
+		kept = append(kept, batch[i])
+	}
+	if len(objs) == 0 {
+		return
+	}
+	err := s.dbCall(ctx, "batch upsert", func(ctx context.Context) error {
+		return s.database.UpsertObjects(ctx, objs)
+	})
+	if err != nil {
+		if ctx.Err() != nil {
 			s.log.Error(err)
-			http.Error(w, "invalid request", http.StatusBadRequest)
-		} else {
-			go func() {
-				for i := range input.ObjectIDs {
-					s.log.Debug("retrieved id: %v", input.ObjectIDs[i])
-					s.inputCh <- input.ObjectIDs[i]
+			return
+		}
+		s.log.Warn("batch upsert of %v objects failed, upserting them one by one: %v", len(objs), err)
+		s.upsertEach(ctx, kept)
+		return
+	}
+	s.log.Debug("upserted batch of %v objects", len(objs))
+	s.metrics.upserts.Add(float64(len(objs)))
+	for i := range kept {
+		s.observeLatency(kept[i])
+	}
+}
+
+// upsertEach writes the tasks of a failed batch one by one, so a single bad row
+// only loses itself instead of the whole batch. Each row still gets the deadline
+// retries of dbCall, one failing after those is counted as dropped.
+// Callers hold the locks of every id.
+func (s *service) upsertEach(ctx context.Context, tasks []task) {
+	for _, t := range tasks {
+		obj := t.obj
+		err := s.dbCall(ctx, "upsert", func(ctx context.Context) error {
+			return s.database.UpsertObject(ctx, obj)
+		})
+		if err != nil {
+			s.objectLog(obj.ID).Error(errors.Wrapf(err, "upserting id %v out of a failed batch", obj.ID))
+			s.metrics.upsertsDropped.Inc()
+			continue
+		}
+		s.metrics.upserts.Inc()
+		s.observeLatency(t)
+	}
+}
+
+// upsertObject persists the object of t unless a newer observation superseded it.
+// Callers serialize it with other writes of the same id.
+func (s *service) upsertObject(ctx context.Context, t task) {
+	defer s.busy()()
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+	obj := t.obj
+	log := s.objectLog(obj.ID)
+	if s.superseded(t) {
+		log.Debug("skipping upsert of id=%v, superseded by a newer observation", obj.ID)
+		return
+	}
+	log.Debug("upserting object: id=%v, online=%v", obj.ID, obj.Online)
+	err := s.dbCall(ctx, "upsert", func(ctx context.Context) error {
+		if s.cfg.RecordObservations {
+			return s.database.UpsertObjectWithEvent(ctx, obj, observationKind(obj))
+		}
+		return s.database.UpsertObject(ctx, obj)
+	})
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	s.metrics.upserts.Inc()
+	s.observeLatency(t)
+}
+
+func observationKind(obj models.Object) string {
+	return observationState(obj.Online)
+}
+
+func observationState(online bool) string {
+	if online {
+		return statusOnline
+	}
+	return statusOffline
+}
+
+// countDeleteSource counts a delete sent to the database by its source, if enabled
+func (s *service) countDeleteSource(t task) {
+	if s.cfg.DeleteMetricsBySource {
+		s.metrics.deletesBySource.WithLabelValues(deleteSources[t.reason]).Inc()
+	}
+}
+
+// observeLatency records how long a task took from its callback to being persisted
+func (s *service) observeLatency(t task) {
+	if !t.acceptedAt.IsZero() {
+		s.metrics.callbackToPersist.Observe(s.clock.Now().Sub(t.acceptedAt).Seconds())
+	}
+}
+
+func (s *service) handleMetricsRoute(_ context.Context) {
+	s.router.Handler(http.MethodGet, "/metrics", s.metrics.registry.Handler())
+}
+
+// logMetrics writes a summary of all metrics to the log every MetricsLogIntervalSec
+func (s *service) logMetrics(ctx context.Context) {
+	interval := time.Duration(s.cfg.MetricsLogIntervalSec) * time.Second
+	ticker := s.clock.NewTimer(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			ticker.Reset(interval)
+			summary, err := s.metrics.registry.Summary()
+			if err != nil {
+				s.log.Error(err)
+				continue
+			}
+			s.log.Info("metrics: %s", summary)
+		}
+	}
+}
+
+func (s *service) listenExternalDeletes(ctx context.Context) {
+	for {
+		err := s.database.ListenDeletes(ctx, s.cfg.DeleteNotifyChannel, func(id models.ID) {
+			if err := validateID(id, s.cfg.StringIDs); err != nil {
+				s.log.Error(errors.Wrapf(err, "ignoring payload on channel %s", s.cfg.DeleteNotifyChannel))
+				return
+			}
+			s.log.Info("deleting object id=%v, reason=%s, channel=%s", id, reasonExternal, s.cfg.DeleteNotifyChannel)
+			s.timers.remove(id)
+			s.observations.forget(id)
+			s.send(ctx, s.deleteCh, task{obj: models.Object{ID: id}, reason: reasonExternal})
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		s.log.Error(errors.Wrap(err, "listening for external deletes"))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second): // reconnect after a while
+		}
+	}
+}
+
+func (s *service) coalesceCallbacks(ctx context.Context) {
+	var (
+		pending = make(map[models.ID]time.Time) // id -> earliest acceptance within the window
+		flush   <-chan time.Time
+	)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case tasks := <-s.coalesceCh:
+			for _, t := range tasks {
+				if acceptedAt, ok := pending[t.obj.ID]; !ok || t.acceptedAt.Before(acceptedAt) {
+					pending[t.obj.ID] = t.acceptedAt
+				}
+			}
+			if flush == nil { // the window starts with the first callback of a batch
+				flush = s.after(time.Duration(s.cfg.CallbackCoalesceMs) * time.Millisecond)
+			}
+		case <-flush:
+			s.log.Debug("flushing batch of %v coalesced ids", len(pending))
+			for id, acceptedAt := range pending {
+				t := s.queue(task{obj: models.Object{ID: id}, acceptedAt: acceptedAt})
+				select {
+				case <-ctx.Done():
+					s.backlog.done(t.seq)
+					return
+				case s.inputCh <- t:
 				}
-			}()
+			}
+			pending = make(map[models.ID]time.Time)
+			flush = nil
 		}
+	}
+}
+
+// callbackTarget is where /callback passes ids to, replaced whenever the HTTP ingester starts
+type callbackTarget struct {
+	ctx context.Context
+	out chan<- models.ID
+}
+
+// handleHealthRoutes registers /health, answering 200 as long as the process serves requests,
+// and /ready, answering 503 until the pipeline runs, Ready reports true and postgres answers a ping
+func (s *service) handleHealthRoutes(_ context.Context) {
+	s.router.GET("/health", func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+		s.writeJSON(w, http.StatusOK, models.HealthStatus{Status: "ok"})
 	})
+	s.router.GET("/ready", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		status := models.ReadyStatus{
+			Status:        "ok",
+			Database:      "ok",
+			Started:       atomic.LoadInt32(&s.started) == 1,
+			ColdStartDone: s.ColdStartDone(),
+			TesterReached: atomic.LoadInt32(&s.testerReached) == 1,
+			Draining:      s.Draining(),
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), readyPingTimeout)
+		defer cancel()
+		if err := s.database.Ping(ctx); err != nil {
+			s.log.Warn("readiness ping to postgres failed: %v", err)
+			status.Database = err.Error()
+		}
+		code := http.StatusOK
+		if status.Database != "ok" || !status.Started || status.Draining || !s.Ready() {
+			status.Status = "unavailable"
+			code = http.StatusServiceUnavailable
+		}
+		s.writeJSON(w, code, status)
+	})
+}
+
+// setCallbackTarget points /callback at out, so starting the ingester again routes
+// callbacks to the latest run
+func (s *service) setCallbackTarget(ctx context.Context, out chan<- models.ID) {
+	s.callbackMu.Lock()
+	s.callback = &callbackTarget{ctx: ctx, out: out}
+	s.callbackMu.Unlock()
+}
+
+func (s *service) serveCallback(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	s.metrics.callbacks.Inc()
+	s.callbackMu.Lock()
+	target := s.callback
+	s.callbackMu.Unlock()
+	if target == nil {
+		w.Header().Set("Retry-After", "1")
+		s.writeError(w, http.StatusServiceUnavailable, "not accepting callbacks yet")
+		return
+	}
+	ctx, out := target.ctx, target.out
+	if s.work.stopped() || s.Draining() {
+		w.Header().Set("Retry-After", "1")
+		s.writeError(w, http.StatusServiceUnavailable, "shutting down")
+		return
+	}
+	if s.cfg.RejectCallbacksDuringColdStart && !s.ColdStartDone() {
+		w.Header().Set("Retry-After", "1")
+		s.writeError(w, http.StatusServiceUnavailable, "cold start in progress")
+		return
+	}
+	release, ok := s.acquireCallbackSlot()
+	if !ok {
+		w.Header().Set("Retry-After", "1")
+		s.writeError(w, http.StatusServiceUnavailable, "too many callbacks in progress")
+		return
+	}
+	if s.cfg.MaxCallbackBodyBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(s.cfg.MaxCallbackBodyBytes))
+	}
+	if isNDJSON(r) {
+		defer release()
+		s.handleNDJSONCallback(ctx, out, w, r)
+		return
+	}
+	var (
+		input    models.ObjectsInput
+		captured *cappedBuffer
+		capture  io.Writer
+	)
+	if s.cfg.CaptureMalformedCallbacks {
+		captured = &cappedBuffer{limit: capturedBodyLimit}
+		capture = captured
+	}
+	err := decodeBody(r, &input, capture, s.cfg.StrictCallbackFields)
+	if errBodyClose := r.Body.Close(); errBodyClose != nil {
+		s.log.Error(errBodyClose)
+	}
+	if err == io.EOF {
+		err = errEmptyBody
+	}
+	if err == nil {
+		err = validateIDs(input.ObjectIDs, s.cfg.StringIDs)
+		if err == nil && len(input.ObjectIDs) == 0 {
+			err = errNoObjectIDs
+		}
+	}
+	switch {
+	case err == errEmptyBody: // a client mistake, nothing worth an error line
+		s.log.Debug("rejecting callback from %s with an empty body", r.RemoteAddr)
+		s.writeCallbackError(w, err, "")
+		release()
+	case err != nil:
+		s.log.Error(err)
+		if captured != nil {
+			s.log.Warn("malformed callback body from %s (first %v bytes): %q", r.RemoteAddr, capturedBodyLimit, captured.Bytes())
+		}
+		s.writeCallbackError(w, err, "")
+		release()
+	default:
+		if s.cfg.CallbackDebugEcho {
+			batchID := newBatchID()
+			s.log.Debug("accepted batch %s with %v ids", batchID, len(input.ObjectIDs))
+			s.writeJSON(w, http.StatusAccepted, models.CallbackEcho{BatchID: batchID, ObjectIDs: input.ObjectIDs})
+		} else {
+			s.writeJSON(w, http.StatusAccepted, models.CallbackAccepted{Enqueued: len(input.ObjectIDs)})
+		}
+		go func() {
+			defer release()
+			s.push(ctx, out, input.ObjectIDs)
+		}()
+	}
+}
+
+// acquireCallbackSlot reserves one of MaxConcurrentCallbacks slots without waiting, reporting false when all are taken
+func (s *service) acquireCallbackSlot() (func(), bool) {
+	if s.callbackSlots == nil {
+		return func() {}, true
+	}
+	select {
+	case s.callbackSlots <- struct{}{}:
+		return func() { <-s.callbackSlots }, true
+	default:
+		return nil, false
+	}
+}
+
+// handleNDJSONCallback streams newline delimited callbacks, each line being either an ObjectsInput or a bare id,
+// passing ids on as they are decoded instead of buffering the whole body
+func (s *service) handleNDJSONCallback(ctx context.Context, out chan<- models.ID, w http.ResponseWriter, r *http.Request) {
+	n, err := decodeNDJSON(r, func(ids []models.ID) error {
+		if err := validateIDs(ids, s.cfg.StringIDs); err != nil {
+			return err
+		}
+		s.push(ctx, out, ids)
+		return nil
+	}, s.cfg.StrictCallbackFields)
+	if errBodyClose := r.Body.Close(); errBodyClose != nil {
+		s.log.Error(errBodyClose)
+	}
+	if err == nil && n == 0 {
+		err = errNoObjectIDs
+	}
+	if err != nil {
+		s.log.Error(err)
+		s.writeCallbackError(w, err, fmt.Sprintf(" after %v ids", n))
+		return
+	}
+	s.log.Debug("accepted %v ids from ndjson callback", n)
+	s.writeJSON(w, http.StatusAccepted, models.CallbackAccepted{Enqueued: n})
+}
+
+// writeCallbackError answers a rejected callback body, suffix tells how far a streamed body got
+func (s *service) writeCallbackError(w http.ResponseWriter, err error, suffix string) {
+	if field, ok := unknownField(err); ok {
+		s.writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown field %q%s", field, suffix))
+		return
+	}
+	switch {
+	case bodyTooLarge(err):
+		s.writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("body exceeds %v bytes", s.cfg.MaxCallbackBodyBytes))
+	case err == errNoObjectIDs, err == errEmptyBody, isInvalidID(err):
+		s.writeError(w, http.StatusBadRequest, err.Error()+suffix)
+	default:
+		s.writeError(w, http.StatusBadRequest, "invalid request"+suffix)
+	}
+}
+
+// push passes ids received by a callback on to out. It gives up on the remaining ids once the
+// service shuts down or CallbackEnqueueTimeoutSec passed, so a blocked pipeline can't keep
+// callback goroutines around forever.
+func (s *service) push(ctx context.Context, out chan<- models.ID, ids []models.ID) {
+	if s.cfg.CallbackEnqueueTimeoutSec > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(s.cfg.CallbackEnqueueTimeoutSec)*time.Second)
+		defer cancel()
+	}
+	for i := range ids {
+		select {
+		case <-ctx.Done():
+			s.log.Warn("dropping %v callback ids, pipeline didn't accept them: %v", len(ids)-i, ctx.Err())
+			return
+		case out <- ids[i]:
+		}
+	}
+}
+
+// enqueue passes an ingested id on to the pipeline
+func (s *service) enqueue(ctx context.Context, id models.ID) {
+	t := task{obj: models.Object{ID: id}, acceptedAt: s.clock.Now()}
+	if s.cfg.CallbackCoalesceMs > 0 {
+		select {
+		case <-ctx.Done():
+		case s.coalesceCh <- []task{t}:
+		}
+		return
+	}
+	s.log.Debug("retrieved id: %v", id)
+	t = s.queue(t)
+	select {
+	case <-ctx.Done():
+		s.backlog.done(t.seq)
+	case s.inputCh <- t:
+	}
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "never"
+	}
+	return t.UTC().String()
+}
+
+func newBatchID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
 }
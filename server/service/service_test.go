@@ -0,0 +1,169 @@
+package service
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// resetSingleton forgets the instance shared through Load, before and after the test
+func resetSingleton(t *testing.T) {
+	reset := func() {
+		mu.Lock()
+		singleton = nil
+		mu.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestUninitializedServiceReportsNotLoaded(t *testing.T) {
+	var s *service
+	if err := s.Run(context.Background()); err != errNotLoaded {
+		t.Fatalf("Run on nil service returned %v, want %v", err, errNotLoaded)
+	}
+	s.Drain()
+	s.SetIngester(nil)
+	s.SetReceiptSink(nil)
+	if s.ColdStartDone() || s.Ready() || s.Draining() {
+		t.Fatal("nil service reports progress it can't have made")
+	}
+}
+
+func TestLoadRequiresDependencies(t *testing.T) {
+	resetSingleton(t)
+	if _, err := Load(nil, newFakeLogger(), testConfig()); err != errMissingDeps {
+		t.Fatalf("Load without database returned %v, want %v", err, errMissingDeps)
+	}
+	if _, err := Load(newFakeDB(), nil, testConfig()); err != errMissingDeps {
+		t.Fatalf("Load without logger returned %v, want %v", err, errMissingDeps)
+	}
+}
+
+func TestLoadRetriesAfterFailure(t *testing.T) {
+	resetSingleton(t)
+	cfg := testConfig()
+	cfg.HTTP.TesterCAFile = filepath.Join(t.TempDir(), "missing.pem")
+	if s, err := Load(newFakeDB(), newFakeLogger(), cfg); err == nil || s != nil {
+		t.Fatalf("Load with a missing CA bundle returned %v, %v, want an error", s, err)
+	}
+
+	cfg.HTTP.TesterCAFile = ""
+	first, err := Load(newFakeDB(), newFakeLogger(), cfg)
+	if err != nil || first == nil {
+		t.Fatalf("Load after fixing the config returned %v, %v, want a service", first, err)
+	}
+	second, err := Load(newFakeDB(), newFakeLogger(), cfg)
+	if err != nil || second != first {
+		t.Fatalf("second Load returned %p, %v, want the first instance %p", second, err, first)
+	}
+}
+
+func TestRetentionClampedToBounds(t *testing.T) {
+	for _, c := range []struct {
+		policy, min, max int
+		want             time.Duration
+	}{
+		{policy: 30, want: 30 * time.Second},
+		{policy: 5, min: 10, max: 60, want: 10 * time.Second},
+		{policy: 600, min: 10, max: 60, want: 60 * time.Second},
+		{policy: 30, min: 10, max: 60, want: 30 * time.Second},
+	} {
+		cfg := testConfig()
+		cfg.RetentionPolicySec, cfg.MinRetentionSec, cfg.MaxRetentionSec = c.policy, c.min, c.max
+		s, _ := newTestService(t, newFakeDB(), cfg)
+		if got := s.retention(); got != c.want {
+			t.Errorf("retention %vs within [%v, %v] is %v, want %v", c.policy, c.min, c.max, got, c.want)
+		}
+	}
+}
+
+func TestExtremeMaxObjectsPerRequestWarns(t *testing.T) {
+	cfg := testConfig()
+	cfg.ChannelBufferSize = 10 // keep the test from allocating the channels the warning is about
+	_, log := newTestService(t, newFakeDB(), cfg)
+	if log.has("WARN", "is extreme") {
+		t.Fatalf("warned about MAX_OBJECTS_PER_REQUEST=%v", cfg.MaxObjectsPerRequest)
+	}
+
+	cfg.MaxObjectsPerRequest = extremeMaxObjectsPerRequest + 1
+	_, log = newTestService(t, newFakeDB(), cfg)
+	if !log.has("WARN", "MAX_OBJECTS_PER_REQUEST=10001 is extreme") {
+		t.Fatalf("no warning for an extreme MAX_OBJECTS_PER_REQUEST:\n%s", log.all())
+	}
+}
+
+func TestServicesKeepSeparateMetrics(t *testing.T) {
+	first, firstLog := newTestService(t, newFakeDB(), testConfig())
+	second, secondLog := newTestService(t, newFakeDB(), testConfig())
+	first.metrics.callbacks.Inc()
+	if n := counterValue(t, second.metrics.callbacks); n != 0 {
+		t.Fatalf("second instance counted %v callbacks of the first", n)
+	}
+	if firstLog.has("ERROR", "registering metric") || secondLog.has("ERROR", "registering metric") {
+		t.Fatalf("registering metrics of a second instance failed:\n%s\n%s", firstLog.all(), secondLog.all())
+	}
+}
+
+func TestLoadAndRunTwice(t *testing.T) {
+	resetSingleton(t)
+	cfg := testConfig()
+	cfg.SkipColdStart = true
+	first, err := Load(newFakeDB(), newFakeLogger(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Load(newFakeDB(), newFakeLogger(), cfg)
+	if err != nil || second != first {
+		t.Fatalf("second Load returned %p, %v, want the first instance %p", second, err, first)
+	}
+	stop := runService(t, first)
+	if err := second.Run(context.Background()); err != errAlreadyRunning {
+		t.Fatalf("second Run returned %v, want %v", err, errAlreadyRunning)
+	}
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentRunStartsOnce(t *testing.T) {
+	cfg := testConfig()
+	cfg.SkipColdStart = true
+	s, log := newTestService(t, newFakeDB(), cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const calls = 8
+	results := make(chan error, calls)
+	start := make(chan struct{})
+	for i := 0; i < calls; i++ {
+		go func() {
+			<-start
+			results <- s.Run(ctx)
+		}()
+	}
+	close(start)
+	for i := 0; i < calls-1; i++ {
+		select {
+		case err := <-results:
+			if err != errAlreadyRunning {
+				t.Fatalf("concurrent Run returned %v, want %v", err, errAlreadyRunning)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %v of %v concurrent Run calls were refused", i, calls-1)
+		}
+	}
+	cancel()
+	select {
+	case err := <-results:
+		if err != nil {
+			t.Fatalf("the Run that started returned %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the Run that started didn't return after cancelling its context")
+	}
+	if n := log.count("WARN", "service is already running"); n != calls-1 {
+		t.Fatalf("warned about %v repeated Run calls, want %v", n, calls-1)
+	}
+}
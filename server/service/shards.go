@@ -0,0 +1,75 @@
+package service
+
+import (
+	"context"
+
+	"github.com/poodbooq/bitburst_server/models"
+)
+
+// shardOp is a write queued on the shard owning its id
+type shardOp struct {
+	t      task
+	upsert bool // delete otherwise
+}
+
+func (s *service) shardOf(id models.ID) chan shardOp {
+	return s.shards[hashID(id)%uint32(len(s.shards))]
+}
+
+// dispatchToShards moves writes from ch to the shard owning their id. All writes of one id
+// end up on the same worker, so they run in the order they were queued without per-id locks.
+func (s *service) dispatchToShards(ctx context.Context, ch <-chan task, upsert bool) {
+	dispatch := func(t task) bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case s.shardOf(t.obj.ID) <- shardOp{t: t, upsert: upsert}:
+			return true
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.intakeStopped:
+			for _, t := range queued(ch) {
+				if !dispatch(t) {
+					return
+				}
+			}
+			return
+		case t := <-ch:
+			if !dispatch(t) {
+				return
+			}
+		}
+	}
+}
+
+// runShard persists the writes queued on ops in order, emptying ops once dispatching stopped
+func (s *service) runShard(ctx context.Context, ops <-chan shardOp) {
+	run := func(op shardOp) {
+		if op.upsert {
+			s.upsertObject(ctx, op.t)
+		} else {
+			s.deleteObject(ctx, op.t)
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.dispatchStopped:
+			for {
+				select {
+				case op := <-ops:
+					run(op)
+				default:
+					return
+				}
+			}
+		case op := <-ops:
+			run(op)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/poodbooq/bitburst_server/models"
+)
+
+func TestShardsKeepWritesOfOneIDOrdered(t *testing.T) {
+	cfg := testConfig()
+	cfg.SkipColdStart = true
+	cfg.WorkerShards = 4
+	db := newFakeDB()
+	var (
+		mu       sync.Mutex
+		inflight = make(map[models.ID]bool)
+	)
+	db.setHook(func(ctx context.Context, op string, ids []models.ID) error {
+		if op != "upsert" {
+			return nil
+		}
+		id := ids[0]
+		mu.Lock()
+		if inflight[id] {
+			t.Errorf("two writes of id %v ran at once", id)
+		}
+		inflight[id] = true
+		mu.Unlock()
+		time.Sleep(time.Duration(rand.Intn(200)) * time.Microsecond) // lets the shards interleave
+		mu.Lock()
+		inflight[id] = false
+		mu.Unlock()
+		return nil
+	})
+	s, log := newTestService(t, db, cfg)
+	runService(t, s)
+
+	const ids, writesPerID = 16, 10
+	shardOfID := make(map[models.ID]chan shardOp)
+	shardsUsed := make(map[chan shardOp]bool)
+	for i := 0; i < writesPerID; i++ {
+		for n := 1; n <= ids; n++ {
+			id := models.ID(strconv.Itoa(n))
+			if shard, seen := shardOfID[id]; seen && shard != s.shardOf(id) {
+				t.Fatalf("id %v moved to another shard", id)
+			}
+			shardOfID[id] = s.shardOf(id)
+			shardsUsed[shardOfID[id]] = true
+			s.upsertCh <- task{obj: models.Object{ID: id, Online: i%2 == 0}}
+		}
+	}
+	if len(shardsUsed) < 2 {
+		t.Fatalf("%v ids all landed on one of %v shards", ids, cfg.WorkerShards)
+	}
+
+	waitFor(t, "every write", func() bool { return db.callCount("upsert") == ids*writesPerID })
+	for n := 1; n <= ids; n++ {
+		prefix := fmt.Sprintf("upserting object: id=%v, online=", n)
+		var seq []string
+		for _, line := range log.all() {
+			if i := strings.Index(line, prefix); i >= 0 {
+				seq = append(seq, line[i+len(prefix):])
+			}
+		}
+		if len(seq) != writesPerID {
+			t.Fatalf("%v writes of id %v logged, want %v", len(seq), n, writesPerID)
+		}
+		for i, online := range seq {
+			if want := strconv.FormatBool(i%2 == 0); online != want {
+				t.Fatalf("writes of id %v ran with online=%v, want them alternating in queue order", n, seq)
+			}
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package service
+
+import "sync"
+
+// inflight tracks goroutines that send on or read from the pipeline channels,
+// so shutdown can wait for all of them before closing the channels
+type inflight struct {
+	mu       sync.RWMutex
+	stopping bool
+	wg       sync.WaitGroup
+}
+
+// spawn runs fn on a tracked goroutine, refusing once the shutdown began
+func (f *inflight) spawn(fn func()) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.stopping {
+		return false
+	}
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		fn()
+	}()
+	return true
+}
+
+// stop refuses further spawns, so wait can't miss goroutines started while it runs
+func (f *inflight) stop() {
+	f.mu.Lock()
+	f.stopping = true
+	f.mu.Unlock()
+}
+
+func (f *inflight) stopped() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.stopping
+}
+
+func (f *inflight) wait() {
+	f.wg.Wait()
+}
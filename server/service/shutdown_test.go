@@ -0,0 +1,297 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/poodbooq/bitburst_server/logger"
+	"github.com/poodbooq/bitburst_server/models"
+)
+
+// startRun runs s in the background, returning the cancel of its context and Run's result
+func startRun(t *testing.T, s *service) (context.CancelFunc, <-chan error) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+	waitFor(t, "pipeline start", func() bool { return atomic.LoadInt32(&s.started) == 1 })
+	t.Cleanup(cancel)
+	return cancel, done
+}
+
+func awaitRun(t *testing.T, done <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run didn't return after cancelling its context")
+		return nil
+	}
+}
+
+// blockingLogger holds the first With call for an object until released, pinning the expiration loop
+// between taking an object off expirationCh and arming its timer
+type blockingLogger struct {
+	fakeLogger
+	once    *sync.Once
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (l blockingLogger) With(key string, value interface{}) logger.Logger {
+	l.once.Do(func() {
+		l.entered <- struct{}{}
+		<-l.release
+	})
+	return l.fakeLogger.With(key, value)
+}
+
+func TestShutdownWaitsForExpirationLoop(t *testing.T) {
+	seen := time.Now().UTC()
+	cfg := testConfig()
+	cfg.LogObjectID = true
+	s, log := newTestService(t, newFakeDB(models.Object{ID: "1", LastSeenAt: &seen, Online: true}), cfg)
+	blocking := blockingLogger{fakeLogger: log, once: new(sync.Once), entered: make(chan struct{}, 1), release: make(chan struct{})}
+	s.log = blocking
+	clock := newFakeClock(time.Now())
+	s.SetClock(clock)
+	cancel, done := startRun(t, s)
+
+	<-blocking.entered // the expiration loop took the cold started object and is about to arm its timer
+	cancel()
+	select {
+	case err := <-done:
+		t.Fatalf("Run returned %v while the expiration loop was still arming a timer", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(blocking.release)
+	if err := awaitRun(t, done); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.timerCount(); n != 0 {
+		t.Errorf("%v timers left armed after shutdown", n)
+	}
+	if n := clock.pending(); n != 0 {
+		t.Errorf("%v timers still running after shutdown", n)
+	}
+}
+
+func TestShutdownPersistsQueuedWrites(t *testing.T) {
+	cfg := testConfig()
+	useTester(t, &cfg, newTester(t, func(models.ID) bool { return true }))
+	cfg.SkipColdStart = true
+	cfg.DBMaxConcurrentWrites = 1
+	cfg.ShutdownTimeoutSec = 5
+	db := newFakeDB()
+	release := make(chan struct{})
+	db.setHook(func(ctx context.Context, op string, ids []models.ID) error {
+		if op == "upsert" && ids[0] == "1" {
+			<-release
+		}
+		return nil
+	})
+	s, _ := newTestService(t, db, cfg)
+	ingester := newFakeIngester()
+	s.SetIngester(ingester)
+	cancel, done := startRun(t, s)
+	<-ingester.started
+
+	ingester.send(t, "1")
+	waitFor(t, "first upsert to hold the only write slot", func() bool { return db.callCount("upsert") == 1 })
+	ingester.send(t, "2", "3", "4", "5")
+	waitFor(t, "the rest to queue behind it", func() bool { return len(s.upsertCh) == 3 })
+
+	cancel()
+	close(release)
+	if err := awaitRun(t, done); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		if id := models.ID(strconv.Itoa(i)); !db.has(id) {
+			t.Errorf("object %v accepted before shutdown was never persisted", id)
+		}
+	}
+}
+
+func TestShutdownTimeoutAbandonsStuckWrites(t *testing.T) {
+	cfg := testConfig()
+	useTester(t, &cfg, newTester(t, func(models.ID) bool { return true }))
+	cfg.SkipColdStart = true
+	cfg.ShutdownTimeoutSec = 1
+	db := newFakeDB()
+	abandoned := make(chan struct{})
+	db.setHook(func(ctx context.Context, op string, ids []models.ID) error {
+		if op == "upsert" {
+			<-ctx.Done() // a write stuck on an unresponsive database
+			close(abandoned)
+		}
+		return nil
+	})
+	s, _ := newTestService(t, db, cfg)
+	ingester := newFakeIngester()
+	s.SetIngester(ingester)
+	cancel, done := startRun(t, s)
+	<-ingester.started
+
+	ingester.send(t, "1")
+	waitFor(t, "upsert to start", func() bool { return db.callCount("upsert") == 1 })
+	cancel()
+	select {
+	case <-abandoned:
+		t.Fatal("the shutdown cancelled a write in flight before its grace period ran out")
+	case <-time.After(200 * time.Millisecond):
+	}
+	if err := awaitRun(t, done); err != errShutdownTimeout {
+		t.Fatalf("Run returned %v, want %v", err, errShutdownTimeout)
+	}
+	select {
+	case <-abandoned:
+	case <-time.After(time.Second):
+		t.Fatal("the stuck write's context outlived the grace period")
+	}
+}
+
+func TestShutdownFlushesDeferredDeletes(t *testing.T) {
+	cfg := testConfig()
+	useTester(t, &cfg, newTester(t, func(models.ID) bool { return false }))
+	cfg.SkipColdStart = true
+	cfg.DeleteBatchSize = 10
+	cfg.DeleteFlushMs = 60000 // only the shutdown flushes
+	cfg.ShutdownTimeoutSec = 5
+	seen := time.Now().UTC()
+	db := newFakeDB(
+		models.Object{ID: "1", LastSeenAt: &seen, Online: true},
+		models.Object{ID: "2", LastSeenAt: &seen, Online: true},
+		models.Object{ID: "3", LastSeenAt: &seen, Online: true},
+	)
+	s, log := newTestService(t, db, cfg)
+	ingester := newFakeIngester()
+	s.SetIngester(ingester)
+	cancel, done := startRun(t, s)
+	<-ingester.started
+
+	ingester.send(t, "1", "2", "3")
+	waitFor(t, "offline objects to wait in the delete batch", func() bool {
+		return log.count("DEBUG", "online=false") == 3 && len(s.deleteCh) == 0
+	})
+	if db.callCount("delete_batch") != 0 {
+		t.Fatal("batch flushed before its window ran out")
+	}
+	cancel()
+	if err := awaitRun(t, done); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []models.ID{"1", "2", "3"} {
+		if db.has(id) {
+			t.Errorf("pending delete of %v dropped on shutdown", id)
+		}
+	}
+	if !log.has("INFO", "flushing 3 pending deletes before shutdown") {
+		t.Errorf("shutdown flush not logged:\n%s", log.all())
+	}
+}
+
+func TestShutdownCompletesWithinGracePeriodDespiteStuckDrain(t *testing.T) {
+	cfg := testConfig()
+	useTester(t, &cfg, newTester(t, func(models.ID) bool { return false }))
+	cfg.SkipColdStart = true
+	cfg.ShutdownTimeoutSec = 1
+	seen := time.Now().UTC()
+	db := newFakeDB(models.Object{ID: "1", LastSeenAt: &seen, Online: true})
+	stuck := make(chan struct{})
+	t.Cleanup(func() { close(stuck) })
+	db.setHook(func(ctx context.Context, op string, ids []models.ID) error {
+		if op == "delete" {
+			<-stuck // ignores its context, the drain can't finish on its own
+		}
+		return nil
+	})
+	s, _ := newTestService(t, db, cfg)
+	ingester := newFakeIngester()
+	s.SetIngester(ingester)
+	cancel, done := startRun(t, s)
+	<-ingester.started
+
+	ingester.send(t, "1")
+	waitFor(t, "delete to get stuck", func() bool { return db.callCount("delete") == 1 })
+	start := time.Now()
+	cancel()
+	if err := awaitRun(t, done); err != errShutdownTimeout {
+		t.Fatalf("Run returned %v, want %v", err, errShutdownTimeout)
+	}
+	if elapsed, limit := time.Since(start), time.Duration(cfg.ShutdownTimeoutSec)*time.Second+500*time.Millisecond; elapsed > limit {
+		t.Fatalf("shutdown took %v with a %vs grace period", elapsed, cfg.ShutdownTimeoutSec)
+	}
+}
+
+func TestTimersFiringAtShutdownDontPanic(t *testing.T) {
+	for round := 0; round < 20; round++ {
+		cfg := testConfig()
+		useTester(t, &cfg, newTester(t, func(models.ID) bool { return true }))
+		cfg.SkipColdStart = true
+		db := newFakeDB()
+		s, _ := newTestService(t, db, cfg)
+		clock := newFakeClock(time.Now())
+		s.SetClock(clock)
+		ingester := newFakeIngester()
+		s.SetIngester(ingester)
+		cancel, done := startRun(t, s)
+		<-ingester.started
+		for i := 1; i <= 20; i++ {
+			ingester.send(t, models.ID(strconv.Itoa(i)))
+		}
+		waitFor(t, "every timer armed", func() bool { return s.timerCount() == 20 })
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() { defer wg.Done(); cancel() }()
+		go func() { defer wg.Done(); clock.Advance(s.retention()) }() // every timer fires as the shutdown starts
+		wg.Wait()
+		if err := awaitRun(t, done); err != nil {
+			t.Fatalf("round %v: Run returned %v", round, err)
+		}
+	}
+}
+
+func TestDrainRejectsCallbacksWhileProcessingCompletes(t *testing.T) {
+	release := make(chan struct{})
+	var once sync.Once
+	unblock := func() { once.Do(func() { close(release) }) }
+	tester := newTester(t, func(models.ID) bool {
+		<-release // a lookup still in flight when the drain starts
+		return true
+	})
+	t.Cleanup(unblock)
+	cfg := testConfig()
+	useTester(t, &cfg, tester)
+	cfg.SkipColdStart = true
+	db := newFakeDB()
+	s, _ := newTestService(t, db, cfg)
+	runService(t, s)
+	waitFor(t, "callback ingester", func() bool { return s.callbackTargetOut() != nil })
+
+	if rec := postCallback(s, `{"object_ids":[1,2]}`); rec.Code != http.StatusAccepted {
+		t.Fatalf("callback before the drain answered %v: %s", rec.Code, rec.Body)
+	}
+	waitFor(t, "lookups in flight", func() bool { return s.pipelineStatus().ActiveWorkers == 2 })
+	s.Drain()
+
+	if rec := postCallback(s, `{"object_ids":[3]}`); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("callback during the drain answered %v, want 503", rec.Code)
+	}
+	if rec := serve(s, httptest.NewRequest(http.MethodGet, "/ready", nil)); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("/ready during the drain answered %v, want 503", rec.Code)
+	}
+	unblock()
+	waitFor(t, "ids accepted before the drain to be stored", func() bool { return db.has("1") && db.has("2") })
+	if db.has("3") {
+		t.Error("id refused during the drain was processed")
+	}
+}
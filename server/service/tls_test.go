@@ -0,0 +1,211 @@
+package service
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/poodbooq/bitburst_server/models"
+)
+
+// testCA issues certificates for TLS tests, writing them as PEM files into a temporary directory
+type testCA struct {
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string // the CA certificate, for TesterCAFile
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	ca := &testCA{t: t, dir: t.TempDir()}
+	ca.cert, ca.key = ca.issue(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+	ca.file = ca.write("ca.pem", "CERTIFICATE", ca.cert.Raw)
+	return ca
+}
+
+// issue signs template with the CA, or self-signs it while the CA itself is created
+func (ca *testCA) issue(template *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	ca.t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	parent, signer := template, key
+	if ca.cert != nil {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return cert, key
+}
+
+// leaf issues a certificate for usage, returning it loaded and as PEM files
+func (ca *testCA) leaf(name string, usage x509.ExtKeyUsage) (tls.Certificate, string, string) {
+	ca.t.Helper()
+	cert, key := ca.issue(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{usage},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+	})
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	certFile := ca.write(name+".pem", "CERTIFICATE", cert.Raw)
+	keyFile := ca.write(name+"-key.pem", "EC PRIVATE KEY", keyDER)
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return pair, certFile, keyFile
+}
+
+func (ca *testCA) write(name, blockType string, der []byte) string {
+	ca.t.Helper()
+	path := filepath.Join(ca.dir, name)
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		ca.t.Fatal(err)
+	}
+	return path
+}
+
+// newTLSTester serves the same answers as newTester over TLS with cert, requiring client certificates
+// issued by clientCA unless it is nil
+func newTLSTester(t *testing.T, cert tls.Certificate, clientCA *testCA) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := models.ID(strings.TrimPrefix(r.URL.Path, "/objects/"))
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(models.Object{ID: id, Online: true})
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	if clientCA != nil {
+		pool := x509.NewCertPool()
+		pool.AddCert(clientCA.cert)
+		srv.TLS.ClientAuth, srv.TLS.ClientCAs = tls.RequireAndVerifyClientCert, pool
+	}
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0) // rejected handshakes are expected
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestMutualTLSWithTester(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert, _, _ := ca.leaf("tester", x509.ExtKeyUsageServerAuth)
+	_, certFile, keyFile := ca.leaf("client", x509.ExtKeyUsageClientAuth)
+	srv := newTLSTester(t, serverCert, ca)
+
+	cfg := testConfig()
+	useTester(t, &cfg, srv)
+	cfg.HTTP.TesterCAFile = ca.file
+	withoutCert, _ := newTestService(t, newFakeDB(), cfg)
+	if _, err := withoutCert.requestObject(context.Background(), "1"); err == nil {
+		t.Fatal("tester requiring a client certificate accepted a request without one")
+	}
+
+	cfg.HTTP.TesterCertFile, cfg.HTTP.TesterKeyFile = certFile, keyFile
+	s, _ := newTestService(t, newFakeDB(), cfg)
+	obj, err := s.requestObject(context.Background(), "1")
+	if err != nil || obj.ID != "1" || !obj.Online {
+		t.Fatalf("mutual TLS request returned %+v, %v", obj, err)
+	}
+}
+
+func TestUnreadableClientCertificateFailsAtStartup(t *testing.T) {
+	cfg := testConfig()
+	cfg.HTTP.TesterCertFile = filepath.Join(t.TempDir(), "missing.pem")
+	cfg.HTTP.TesterKeyFile = cfg.HTTP.TesterCertFile
+	if _, err := newService(newFakeDB(), newFakeLogger(), cfg); err == nil || !strings.Contains(err.Error(), "loading tester client certificate") {
+		t.Fatalf("missing client certificate returned %v", err)
+	}
+}
+
+func TestInsecureSkipVerifyFlag(t *testing.T) {
+	serverCert, _, _ := newTestCA(t).leaf("tester", x509.ExtKeyUsageServerAuth)
+	srv := newTLSTester(t, serverCert, nil)
+	cfg := testConfig()
+	useTester(t, &cfg, srv)
+	cfg.HTTP.TesterInsecureSkipVerify = true
+	s, log := newTestService(t, newFakeDB(), cfg)
+
+	tr := s.httpClient.Transport.(*http.Transport)
+	if tr.TLSClientConfig == nil || !tr.TLSClientConfig.InsecureSkipVerify {
+		t.Fatal("TesterInsecureSkipVerify didn't reach the transport")
+	}
+	if !log.has("WARN", "TLS certificate verification of the tester is DISABLED") {
+		t.Fatalf("disabled verification not warned about:\n%s", log.all())
+	}
+	if _, err := s.requestObject(context.Background(), "1"); err != nil {
+		t.Fatalf("request to an untrusted tester failed with verification disabled: %v", err)
+	}
+}
+
+func TestCustomCAValidatesTester(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert, _, _ := ca.leaf("tester", x509.ExtKeyUsageServerAuth)
+	srv := newTLSTester(t, serverCert, nil)
+
+	for _, tc := range []struct {
+		name, caFile string
+		ok           bool
+	}{
+		{"no CA configured", "", false},
+		{"another CA", newTestCA(t).file, false},
+		{"the tester's CA", ca.file, true},
+	} {
+		cfg := testConfig()
+		useTester(t, &cfg, srv)
+		cfg.HTTP.TesterCAFile = tc.caFile
+		s, _ := newTestService(t, newFakeDB(), cfg)
+		obj, err := s.requestObject(context.Background(), "1")
+		if tc.ok && (err != nil || !obj.Online) {
+			t.Errorf("%s: handshake failed: %v", tc.name, err)
+		}
+		if !tc.ok && (err == nil || !strings.Contains(err.Error(), "certificate")) {
+			t.Errorf("%s: got %+v, %v, want a certificate verification error", tc.name, obj, err)
+		}
+	}
+
+	cfg := testConfig()
+	cfg.HTTP.TesterCAFile = filepath.Join(t.TempDir(), "empty.pem")
+	if err := ioutil.WriteFile(cfg.HTTP.TesterCAFile, []byte("not a certificate\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newService(newFakeDB(), newFakeLogger(), cfg); err == nil || !strings.Contains(err.Error(), "no certificates found in tester CA bundle") {
+		t.Fatalf("unparsable CA bundle returned %v at startup", err)
+	}
+}